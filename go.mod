@@ -7,7 +7,7 @@ replace github.com/creack/pty => github.com/photostorm/pty v1.1.19-0.20230903182
 
 require (
 	github.com/creack/pty v1.1.18
-	golang.org/x/crypto v0.17.0
+	golang.org/x/crypto v0.22.0
+	golang.org/x/sys v0.19.0
+	gopkg.in/yaml.v3 v3.0.1
 )
-
-require golang.org/x/sys v0.15.0 // indirect
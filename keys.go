@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	sshd "github.com/jpillora/sshd-lite/server"
+	"golang.org/x/crypto/ssh"
+)
+
+// keysCommand runs "sshd-lite keys <list|check> ...",
+// and returns the exit status
+func keysCommand(args []string) int {
+	if len(args) == 2 && args[0] == "list" {
+		keys, err := sshd.LoadAuthorizedKeys(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load keys: %s\n", err)
+			return 1
+		}
+		for _, k := range keys {
+			fmt.Printf("%s %s %s\n", sshd.Fingerprint(k.Key), k.Key.Type(), k.Comment)
+		}
+		return 0
+	}
+	if len(args) == 3 && args[0] == "check" {
+		keys, err := sshd.LoadAuthorizedKeys(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load keys: %s\n", err)
+			return 1
+		}
+		//public key may be a file or the key itself
+		b, err := os.ReadFile(args[2])
+		if err != nil {
+			b = []byte(args[2])
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to parse public key: %s\n", err)
+			return 1
+		}
+		for _, k := range keys {
+			if bytes.Equal(k.Key.Marshal(), pub.Marshal()) {
+				fmt.Printf("accepted %s (%s)\n", sshd.Fingerprint(pub), k.Comment)
+				return 0
+			}
+		}
+		fmt.Printf("denied %s\n", sshd.Fingerprint(pub))
+		return 1
+	}
+	fmt.Print(help)
+	return 1
+}
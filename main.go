@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	sshd "github.com/jpillora/sshd-lite/server"
 )
@@ -13,17 +17,32 @@ var version string = "0.0.0-src" //set via ldflags
 
 var help = `
   Usage: sshd-lite [options] <auth>
+         sshd-lite keys list <auth>
+         sshd-lite keys check <auth> <pubkey>
 
   Version: ` + version + `
 
   Options:
     --host, listening interface (defaults to all)
     --port -p, listening port (defaults to 22, then fallsback to 2200)
+    --listen, a listening address ("host:port") used in place of --host
+    and --port, may be repeated to listen on several addresses
     --shell, the type of to use shell for remote sessions (defaults to $SHELL, then bash/powershell)
     --keyfile, a filepath to an private key (for example, an 'id_rsa' file)
     --keyseed, a string to use to seed key generation
+    --keytype, the type of generated keys, ed25519 or rsa (defaults to
+    ed25519, or to rsa with --keyseed, to keep the seeded keys of
+    earlier versions)
     --noenv, ignore environment variables provided by the client
     --keepalive, server keep alive interval seconds (defaults to 60, 0 to disable)
+    --metrics, an address (e.g. "localhost:9022") to serve prometheus
+    metrics over http at /metrics (defaults to disabled)
+    --health, an address to serve health checks over http, responding
+    "OK" and the number of active connections (defaults to disabled)
+    --config, a filepath to a YAML or JSON config file, where keys are
+    lowercased config field names (e.g. "keyfile"). flags override the file.
+    --selftest, start a server on a random local port, run a command
+    in a shell over ssh, and exit with status 0 if its output is correct
     --version, display version
     --verbose -v, verbose logs
 
@@ -31,21 +50,37 @@ var help = `
     1. a username and password string separated by a colon ("myuser:mypass")
     2. a path to an ssh authorized keys file ("~/.ssh/authorized_keys")
     3. an authorized github user ("github.com/myuser") public keys from .keys
-    4. "none" to disable client authentication :WARNING: very insecure
+    4. a URL of an authorized keys file ("https://example.com/keys")
+    5. "none" to disable client authentication :WARNING: very insecure
+    6. keys (2, 3 or 4) and a username and password (1) joined by a
+    plus, to require both ("~/.ssh/authorized_keys+myuser:mypass")
+
+  Commands:
+    keys list, print the fingerprint, type and comment of each key
+    trusted by a key based <auth> (options 2, 3 and 4 above)
+    keys check, report whether <pubkey> (a public key file, or the
+    key itself) would be accepted by <auth>, exiting 1 if not
 
   Notes:
-    * if no keyfile and no keyseed are set, a random RSA2048 key is used
-    * authorized_key files are automatically reloaded on change
+    * if no keyfile and no keyseed are set, a random key is used
+    * the SSHD_HOST_KEY env var may instead hold a PEM encoded private key,
+    which takes precedence over the keyfile and keyseed
+    * authorized_key files are automatically reloaded on change, and
+    github and URL keys are refetched every 5 minutes
     * once authenticated, clients will have access to a shell of the
     current user. sshd-lite does not lookup system users.
-    * sshd-lite only supports remotes shells. tunnelling and command
-    execution are not currently supported.
+    * <auth> may be omitted when it is set by the config file ("authtype")
+    * sshd-lite supports remote shells and command execution
+    ("ssh host <command>"). tunnelling is not currently supported.
 
   Read more: https://github.com/jpillora/sshd-lite
 
 `
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		os.Exit(keysCommand(os.Args[2:]))
+	}
 
 	flag.Usage = func() {
 		fmt.Print(help)
@@ -60,8 +95,14 @@ func main() {
 	flag.StringVar(&c.Shell, "shell", os.Getenv("SHELL"), "")
 	flag.StringVar(&c.KeyFile, "keyfile", "", "")
 	flag.StringVar(&c.KeySeed, "keyseed", "", "")
+	flag.StringVar(&c.KeyType, "keytype", "", "")
 	flag.IntVar(&c.KeepAlive, "keepalive", 60, "")
 	flag.BoolVar(&c.IgnoreEnv, "noenv", false, "")
+	flag.StringVar(&c.MetricsAddr, "metrics", "", "")
+	flag.StringVar(&c.HealthCheckAddr, "health", "", "")
+	listen := listFlag{}
+	flag.Var(&listen, "listen", "")
+	configFile := flag.String("config", "", "")
 
 	//help/version
 	h1f := flag.Bool("h", false, "")
@@ -69,8 +110,27 @@ func main() {
 	v1f := flag.Bool("verbose", false, "")
 	v2f := flag.Bool("v", false, "")
 	vf := flag.Bool("version", false, "")
+	stf := flag.Bool("selftest", false, "")
 	flag.Parse()
 
+	//load config file, then re-apply flags so they take precedence
+	if *configFile != "" {
+		if err := sshd.LoadConfig(*configFile, c); err != nil {
+			log.Fatal(err)
+		}
+		listen = listFlag{}
+		flag.Parse()
+	}
+	if len(listen) > 0 {
+		c.Listen = listen
+	}
+	//a host key in the env (e.g. a container secret) takes precedence
+	if pem := os.Getenv("SSHD_HOST_KEY"); pem != "" {
+		c.KeyPEM = pem
+	}
+	//sessions inherit the environment, so never pass the key on
+	os.Unsetenv("SSHD_HOST_KEY")
+
 	if *vf {
 		fmt.Print(version)
 		os.Exit(0)
@@ -79,20 +139,47 @@ func main() {
 		flag.Usage()
 	}
 
-	c.LogVerbose = *v1f || *v2f
+	if *v1f || *v2f {
+		c.LogVerbose = true
+	}
+
+	if *stf {
+		if err := selftest(c); err != nil {
+			log.Fatalf("Selftest failed: %s", err)
+		}
+		log.Printf("Selftest passed")
+		os.Exit(0)
+	}
 
 	args := flag.Args()
-	if len(args) != 1 {
+	if len(args) == 1 {
+		c.AuthType = args[0]
+	} else if len(args) != 0 || c.AuthType == "" {
 		flag.Usage()
 	}
-	c.AuthType = args[0]
 
 	s, err := sshd.NewServer(c)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = s.Start()
+	//stop listening on interrupt or terminate
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = s.StartContext(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.Printf("Shutting down")
+}
+
+// listFlag is a flag which may be repeated
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
 }
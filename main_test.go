@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	sshd "github.com/jpillora/sshd-lite/server"
+	"golang.org/x/crypto/ssh"
+)
+
+// mainArgsEnv holds the arguments of main, when
+// the test binary is run as sshd-lite by runMain
+const mainArgsEnv = "SSHD_LITE_TEST_ARGS"
+
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv(mainArgsEnv); ok {
+		os.Args = append([]string{"sshd-lite"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs sshd-lite with the given arguments,
+// and returns its output and exit code
+func runMain(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), mainArgsEnv+"="+strings.Join(args, "\n"))
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return string(out), exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), 0
+}
+
+func TestConfigFlags(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(config, []byte("shell: /missing/shell\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	//the file is used...
+	if out, code := runMain(t, "--config", config, "--selftest"); code == 0 {
+		t.Errorf("expected the shell of the config file to fail:\n%s", out)
+	}
+	//...unless a flag is set
+	if out, code := runMain(t, "--config", config, "--shell", "/bin/sh", "--selftest"); code != 0 {
+		t.Errorf("expected the shell flag to take precedence:\n%s", out)
+	}
+}
+
+func TestSelftest(t *testing.T) {
+	if out, code := runMain(t, "--selftest"); code != 0 || !strings.Contains(out, "Selftest passed") {
+		t.Errorf("selftest failed (%d):\n%s", code, out)
+	}
+	//and fails when the shell cannot run
+	if out, code := runMain(t, "--shell", "/missing/shell", "--selftest"); code == 0 {
+		t.Errorf("expected selftest to fail:\n%s", out)
+	}
+}
+
+func newPublicKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestKeysCommand(t *testing.T) {
+	dir := t.TempDir()
+	alice, bob, eve := newPublicKey(t), newPublicKey(t), newPublicKey(t)
+	line := func(k ssh.PublicKey, comment string) string {
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k))) + " " + comment + "\n"
+	}
+	keys := filepath.Join(dir, "authorized_keys")
+	content := "# trusted keys\n" + line(alice, "alice@laptop") + `command="uptime" ` + line(bob, "bob@ci")
+	if err := os.WriteFile(keys, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, code := runMain(t, "keys", "list", keys)
+	want := sshd.Fingerprint(alice) + " ssh-ed25519 alice@laptop\n" +
+		sshd.Fingerprint(bob) + " ssh-ed25519 bob@ci\n"
+	if code != 0 || out != want {
+		t.Errorf("keys list (%d): got %q, want %q", code, out, want)
+	}
+	//the key to check may be a file, or the key itself
+	pubFile := filepath.Join(dir, "bob.pub")
+	os.WriteFile(pubFile, ssh.MarshalAuthorizedKey(bob), 0600)
+	for _, c := range []struct {
+		key  string
+		code int
+		want string
+	}{
+		{pubFile, 0, "accepted " + sshd.Fingerprint(bob) + " (bob@ci)\n"},
+		{strings.TrimSpace(line(alice, "")), 0, "accepted " + sshd.Fingerprint(alice) + " (alice@laptop)\n"},
+		{strings.TrimSpace(line(eve, "")), 1, "denied " + sshd.Fingerprint(eve) + "\n"},
+	} {
+		if out, code := runMain(t, "keys", "check", keys, c.key); code != c.code || out != c.want {
+			t.Errorf("keys check %q (%d): got %q, want %q", c.key, code, out, c.want)
+		}
+	}
+	if _, code := runMain(t, "keys", "check", keys, "not a key"); code != 1 {
+		t.Error("expected an invalid key to fail")
+	}
+	if _, code := runMain(t, "keys", "list", filepath.Join(dir, "missing")); code != 1 {
+		t.Error("expected a missing file to fail")
+	}
+}
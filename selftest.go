@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	sshd "github.com/jpillora/sshd-lite/server"
+	"golang.org/x/crypto/ssh"
+)
+
+const selftestTimeout = 15 * time.Second
+
+// selftest starts a server on a random local port, connects to it
+// with a random password, runs a command in a shell, and verifies
+// its output
+func selftest(c *sshd.Config) error {
+	b := make([]byte, 16)
+	rand.Read(b)
+	pass := fmt.Sprintf("%x", b)
+	c.Host = "127.0.0.1"
+	c.AuthType = "selftest:" + pass
+	s, err := sshd.NewServer(c)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	go s.StartWith(l)
+	//connect
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "selftest",
+		Auth:            []ssh.AuthMethod{ssh.Password(pass)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         selftestTimeout,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to open session: %w", err)
+	}
+	defer session.Close()
+	//a terminal, so the input is echoed back and
+	//its line endings are translated
+	if err := session.RequestPty("xterm", 24, 80, nil); err != nil {
+		return fmt.Errorf("failed to request pty: %w", err)
+	}
+	out := &syncBuffer{}
+	session.Stdout = out
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := session.Shell(); err != nil {
+		return fmt.Errorf("failed to start shell: %w", err)
+	}
+	//quotes are removed by the shell, so the echoed
+	//input won't match the expected output
+	stdin.Write([]byte("echo selftest\"\"-ok\r\n"))
+	deadline := time.Now().Add(selftestTimeout)
+	for time.Now().Before(deadline) {
+		if strings.Contains(out.String(), "selftest-ok") {
+			stdin.Write([]byte("exit\r\n"))
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out waiting for output, got: %q", out.String())
+}
+
+type syncBuffer struct {
+	mut sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,56 @@
+package sshd
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// forwardAgent listens on a private unix socket, and forwards each
+// connection to the client's agent over an "auth-agent@openssh.com"
+// channel. The socket is exposed to the session as SSH_AUTH_SOCK.
+func (s *Server) forwardAgent(sess *session) error {
+	dir, err := os.MkdirTemp("", "sshd-lite-agent-")
+	if err != nil {
+		return err
+	}
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	sess.agent = l
+	sess.env = appendEnv(sess.env, "SSH_AUTH_SOCK="+sock)
+	go func() {
+		defer os.RemoveAll(dir)
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleAgentConn(sess.conn, c)
+		}
+	}()
+	s.debugf("Agent forwarding on %s", sock)
+	return nil
+}
+
+func (s *Server) handleAgentConn(sshConn *ssh.ServerConn, c net.Conn) {
+	defer c.Close()
+	ch, reqs, err := sshConn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		s.debugf("Failed to open agent channel (%s)", err)
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(ch, c)
+		ch.CloseWrite()
+	}()
+	io.Copy(c, ch)
+}
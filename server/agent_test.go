@@ -0,0 +1,87 @@
+//go:build !windows
+
+package sshd
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestAgentForwarding(t *testing.T) {
+	_, pri, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: pri, Comment: "forwarded"}); err != nil {
+		t.Fatal(err)
+	}
+	plain, denied, restricted, allowed := newSigner(t), newSigner(t), newSigner(t), newSigner(t)
+	keys := writeAuthorizedKeys(t,
+		plain,
+		authorizedKey("no-agent-forwarding", denied),
+		authorizedKey("restrict", restricted),
+		authorizedKey("restrict,agent-forwarding", allowed),
+	)
+	for _, c := range []struct {
+		name    string
+		enabled bool
+		key     ssh.Signer
+		ok      bool
+	}{
+		{"disabled", false, plain, false},
+		{"plain key", true, plain, true},
+		{"no-agent-forwarding", true, denied, false},
+		{"restrict", true, restricted, false},
+		{"restrict,agent-forwarding", true, allowed, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			addr := startServer(t, &Config{AuthType: keys, AgentForwarding: c.enabled})
+			client, err := dial(addr, "foo", ssh.PublicKeys(c.key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if err := agent.ForwardToAgent(client, keyring); err != nil {
+				t.Fatal(err)
+			}
+			sess, err := client.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sess.Close()
+			err = agent.RequestAgentForwarding(sess)
+			if (err == nil) != c.ok {
+				t.Fatalf("expected forwarding %v, got %v", c.ok, err)
+			}
+			if !c.ok {
+				return
+			}
+			//the session's agent socket lists the client's key
+			stdout, _ := sess.StdoutPipe()
+			if err := sess.Start("echo $SSH_AUTH_SOCK; sleep 5"); err != nil {
+				t.Fatal(err)
+			}
+			sock, _ := bufio.NewReader(stdout).ReadString('\n')
+			conn, err := net.Dial("unix", strings.TrimSpace(sock))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			list, err := agent.NewClient(conn).List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != 1 || list[0].Comment != "forwarded" {
+				t.Errorf("unexpected agent keys %v", list)
+			}
+		})
+	}
+}
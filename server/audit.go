@@ -0,0 +1,70 @@
+package sshd
+
+import (
+	"encoding/json"
+	"log"
+	"syscall"
+	"time"
+)
+
+// auditEvent is a line of the exec audit log
+type auditEvent struct {
+	Time     time.Time `json:"time"`
+	Remote   string    `json:"remote"`
+	User     string    `json:"user"`
+	Session  string    `json:"session"`
+	Command  string    `json:"command"`
+	ExitCode int       `json:"exit_code"`
+	Signal   string    `json:"signal,omitempty"`
+	Duration float64   `json:"duration"`
+	//refused by the ExecAllowlist, and so never run
+	Rejected bool `json:"rejected,omitempty"`
+}
+
+// auditExec waits for the command of the session to exit,
+// and then writes its audit event to the AuditWriter
+func (s *Server) auditExec(sess *session, command string, start time.Time) {
+	state, _ := sess.proc.wait()
+	e := auditEvent{
+		Time:     start.UTC(),
+		Remote:   sess.conn.RemoteAddr().String(),
+		User:     sess.user(),
+		Session:  sess.id,
+		Command:  command,
+		ExitCode: -1,
+		Duration: time.Since(start).Seconds(),
+	}
+	if state != nil {
+		e.ExitCode = state.ExitCode()
+		if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			e.Signal, _ = signalName(ws.Signal())
+		}
+	}
+	s.writeAudit(e)
+}
+
+// auditRejected writes the audit event of a shell
+// or command refused by the ExecAllowlist
+func (s *Server) auditRejected(sess *session, command string) {
+	if s.cli.AuditWriter == nil {
+		return
+	}
+	s.writeAudit(auditEvent{
+		Time:     time.Now().UTC(),
+		Remote:   sess.conn.RemoteAddr().String(),
+		User:     sess.user(),
+		Session:  sess.id,
+		Command:  command,
+		ExitCode: 1,
+		Rejected: true,
+	})
+}
+
+func (s *Server) writeAudit(e auditEvent) {
+	b, _ := json.Marshal(e)
+	s.auditMut.Lock()
+	defer s.auditMut.Unlock()
+	if _, err := s.cli.AuditWriter.Write(append(b, '\n')); err != nil {
+		log.Printf("Failed to write audit event (%s)", err)
+	}
+}
@@ -0,0 +1,88 @@
+package sshd
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authLogger is the structured logger of authentication
+// and disconnect events
+func (s *Server) authLogger() *slog.Logger {
+	if l := s.cli.AuthLogger; l != nil {
+		return l
+	}
+	return slog.Default()
+}
+
+// authLog records an authentication attempt as an "auth.success"
+// or "auth.failure" event, with any extra attributes (e.g. the
+// fingerprint of a public key)
+func (s *Server) authLog(conn ssh.ConnMetadata, method string, err error, attrs ...any) {
+	attrs = append([]any{
+		"user", conn.User(),
+		"method", method,
+		"remote_ip", remoteIP(conn.RemoteAddr()),
+	}, attrs...)
+	event := "auth.success"
+	var partial *ssh.PartialSuccessError
+	if errors.As(err, &partial) {
+		//passed the first of multiple factors
+		attrs = append(attrs, "partial", true)
+	} else if err != nil {
+		event = "auth.failure"
+		attrs = append(attrs, "error", err.Error())
+	}
+	s.authLogger().Info(event, attrs...)
+	s.event(event, attrs...)
+}
+
+// recordKeys wraps the public key callback of sc, if any, to record
+// the fingerprint of the key last checked for each connection. Keys
+// are checked before their signature is verified (and when clients
+// only query them), so the outcome is logged later, by the
+// AuthLogCallback, once known.
+func (s *Server) recordKeys(sc *ssh.ServerConfig) {
+	pk := sc.PublicKeyCallback
+	if pk == nil {
+		return
+	}
+	sc.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		s.keysMut.Lock()
+		s.checkedKeys[conn.RemoteAddr().String()] = Fingerprint(key)
+		s.keysMut.Unlock()
+		return pk(conn, key)
+	}
+}
+
+// checkedKey is the fingerprint of the key last checked for the
+// connection from remote
+func (s *Server) checkedKey(remote net.Addr) string {
+	s.keysMut.Lock()
+	defer s.keysMut.Unlock()
+	return s.checkedKeys[remote.String()]
+}
+
+// forgetKey is called once the handshake of remote is over
+func (s *Server) forgetKey(remote net.Addr) {
+	s.keysMut.Lock()
+	delete(s.checkedKeys, remote.String())
+	s.keysMut.Unlock()
+}
+
+// disconnectLog records the end of an authenticated connection
+func (s *Server) disconnectLog(user string, remote net.Addr, start time.Time, err error) {
+	attrs := []any{
+		"user", user,
+		"remote_ip", remoteIP(remote),
+		"duration", time.Since(start).Round(time.Millisecond).String(),
+	}
+	if err != nil {
+		attrs = append(attrs, "reason", err.Error())
+	}
+	s.authLogger().Info("disconnect", attrs...)
+	s.event("disconnected", attrs...)
+}
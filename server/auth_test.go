@@ -0,0 +1,304 @@
+package sshd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMultiFactorAuth(t *testing.T) {
+	key := newSigner(t)
+	addr := startServer(t, &Config{
+		AuthType: writeAuthorizedKeys(t, key) + "+foo:bar",
+		KeyboardInteractive: func(user string, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := client(user, "", []string{"Code: "}, []bool{true})
+			if err != nil || len(answers) != 1 || answers[0] != "123456" {
+				return nil, fmt.Errorf("denied")
+			}
+			return nil, nil
+		},
+	})
+	code := ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		return []string{"123456"}, nil
+	})
+	for _, tc := range []struct {
+		name string
+		auth []ssh.AuthMethod
+		ok   bool
+	}{
+		{"key only", []ssh.AuthMethod{ssh.PublicKeys(key)}, false},
+		{"password only", []ssh.AuthMethod{ssh.Password("bar")}, false},
+		{"challenge only", []ssh.AuthMethod{code}, false},
+		{"password and challenge", []ssh.AuthMethod{ssh.Password("bar"), code}, false},
+		{"key and wrong password", []ssh.AuthMethod{ssh.PublicKeys(key), ssh.Password("nope")}, false},
+		{"key and password", []ssh.AuthMethod{ssh.PublicKeys(key), ssh.Password("bar")}, true},
+		{"key and challenge", []ssh.AuthMethod{ssh.PublicKeys(key), code}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := dial(addr, "foo", tc.auth...)
+			if tc.ok && err != nil {
+				t.Fatalf("expected success, got %s", err)
+			}
+			if !tc.ok && err == nil {
+				client.Close()
+				t.Fatal("expected authentication to fail")
+			}
+		})
+	}
+}
+
+// wrongSigner presents one public key, but signs with another
+type wrongSigner struct {
+	ssh.Signer
+	pub ssh.PublicKey
+}
+
+func (w wrongSigner) PublicKey() ssh.PublicKey {
+	return w.pub
+}
+
+func TestPublicKeyAuthLog(t *testing.T) {
+	key, other := newSigner(t), newSigner(t)
+	var mut sync.Mutex
+	var events []string
+	addr := startServer(t, &Config{
+		AuthType: writeAuthorizedKeys(t, key),
+		EventHook: func(event string, attrs map[string]string) {
+			if strings.HasPrefix(event, "auth.") {
+				mut.Lock()
+				events = append(events, event+" "+attrs["fingerprint"])
+				mut.Unlock()
+			}
+		},
+	})
+	takeEvents := func() []string {
+		mut.Lock()
+		defer mut.Unlock()
+		e := events
+		events = nil
+		return e
+	}
+	//the authorized public key, with the wrong private key
+	if client, err := dial(addr, "foo", ssh.PublicKeys(wrongSigner{other, key.PublicKey()})); err == nil {
+		client.Close()
+		t.Fatal("expected authentication to fail")
+	}
+	for _, e := range takeEvents() {
+		if strings.HasPrefix(e, "auth.success") {
+			t.Errorf("unverified key logged as %q", e)
+		}
+	}
+	//an unauthorized key
+	if client, err := dial(addr, "foo", ssh.PublicKeys(other)); err == nil {
+		client.Close()
+		t.Fatal("expected authentication to fail")
+	}
+	want := "auth.failure " + Fingerprint(other.PublicKey())
+	if e := takeEvents(); len(e) != 1 || e[0] != want {
+		t.Errorf("got events %q, want %q", e, want)
+	}
+	//the authorized key
+	client, err := dial(addr, "foo", ssh.PublicKeys(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	want = "auth.success " + Fingerprint(key.PublicKey())
+	if e := takeEvents(); len(e) != 1 || e[0] != want {
+		t.Errorf("got events %q, want %q", e, want)
+	}
+}
+
+func TestKeysFileWithColon(t *testing.T) {
+	key := newSigner(t)
+	//like a windows path, e.g. C:\Users\foo\authorized_keys
+	path := filepath.Join(t.TempDir(), "C:", "authorized_keys")
+	if err := os.Mkdir(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(writeAuthorizedKeys(t, key), path); err != nil {
+		t.Fatal(err)
+	}
+	for _, passwords := range []bool{false, true} {
+		c := &Config{AuthType: path}
+		if passwords {
+			c.PasswordAuth = func(user, password string, remote net.Addr) (bool, error) {
+				return true, nil
+			}
+		}
+		addr := startServer(t, c)
+		client, err := dial(addr, "foo", ssh.PublicKeys(key))
+		if err != nil {
+			t.Fatalf("password callback %v: expected key auth, got %s", passwords, err)
+		}
+		client.Close()
+		if client, err := dial(addr, "foo", ssh.Password("bar")); err == nil {
+			client.Close()
+			t.Errorf("password callback %v: expected password auth to fail", passwords)
+		}
+	}
+}
+
+func TestMaxAuthTries(t *testing.T) {
+	for _, c := range []struct{ max, tries int }{{2, 2}, {0, 6}, {-1, 10}} {
+		addr := startServer(t, &Config{AuthType: "foo:bar", MaxAuthTries: c.max})
+		tries := 0
+		wrong := ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+			tries++
+			return "nope", nil
+		}), 10)
+		if client, err := dial(addr, "foo", wrong); err == nil {
+			client.Close()
+			t.Fatalf("max %d: expected authentication to fail", c.max)
+		}
+		if tries != c.tries {
+			t.Errorf("max %d: expected %d tries, got %d", c.max, c.tries, tries)
+		}
+	}
+}
+
+func TestAuthReloadPolicy(t *testing.T) {
+	a, b := newSigner(t), newSigner(t)
+	write := func(path string, key ssh.Signer, mtime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, ssh.MarshalAuthorizedKey(key.PublicKey()), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	login := func(addr string, key ssh.Signer) bool {
+		client, err := dial(addr, "foo", ssh.PublicKeys(key))
+		if err == nil {
+			client.Close()
+		}
+		return err == nil
+	}
+	now := time.Now()
+	for _, policy := range []string{"fail-open", "fail-closed"} {
+		path := filepath.Join(t.TempDir(), "authorized_keys")
+		write(path, a, now.Add(-time.Hour))
+		addr := startServer(t, &Config{AuthType: path, AuthReloadPolicy: policy})
+		if !login(addr, a) || login(addr, b) {
+			t.Fatalf("%s: expected only the first key", policy)
+		}
+		//updates are reloaded
+		write(path, b, now.Add(-time.Minute))
+		if login(addr, a) || !login(addr, b) {
+			t.Fatalf("%s: expected only the updated key", policy)
+		}
+		//a missing file keeps the last keys only when failing open
+		os.Remove(path)
+		if ok := login(addr, b); ok != (policy == "fail-open") {
+			t.Errorf("%s: missing file, login %v", policy, ok)
+		}
+		//and once restored (even with an old mtime), keys apply again
+		write(path, b, now.Add(-time.Minute))
+		if !login(addr, b) {
+			t.Errorf("%s: expected the restored key", policy)
+		}
+	}
+	if _, err := NewServer(&Config{AuthType: writeAuthorizedKeys(t, a), AuthReloadPolicy: "sometimes"}); err == nil {
+		t.Error("expected an invalid policy error")
+	}
+}
+
+func TestAuthorizeConn(t *testing.T) {
+	key := newSigner(t)
+	//keys with options have permissions to authorize
+	s, err := NewServer(&Config{
+		AuthType: writeAuthorizedKeys(t, authorizedKey(`command="echo forced"`, key)),
+		AuthorizeConn: func(user string, perms *ssh.Permissions, remote net.Addr) error {
+			if user != "allowed" {
+				return fmt.Errorf("user %s is suspended", user)
+			}
+			if perms == nil || perms.Extensions[forceCommandExtension] != "echo forced" {
+				return fmt.Errorf("unexpected permissions %+v", perms)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, s)
+	client, err := dial(addr, "allowed", ssh.PublicKeys(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := run(t, client, "echo ok"); err != nil || out != "forced\n" {
+		t.Errorf("unexpected output %q (%v)", out, err)
+	}
+	client.Close()
+	//the rejected user has authenticated, and is then disconnected
+	//without being told why
+	client, err = dial(addr, "suspended", ssh.PublicKeys(key))
+	if err != nil {
+		t.Fatalf("expected the handshake to succeed, got %s", err)
+	}
+	defer client.Close()
+	if _, err := client.NewSession(); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+	if n := s.Stats().Connections; n != 1 {
+		t.Errorf("expected 1 connection counted, got %d", n)
+	}
+}
+
+func TestPasswordAuth(t *testing.T) {
+	key := newSigner(t)
+	check := func(user, password string, remote net.Addr) (bool, error) {
+		if user == "broken" {
+			return false, fmt.Errorf("database unavailable")
+		}
+		return user == "alice" && password == "secret" && remote != nil, nil
+	}
+	for _, auth := range []string{"", "password"} {
+		addr := startServer(t, &Config{AuthType: auth, PasswordAuth: check})
+		for _, c := range []struct {
+			user, password string
+			ok             bool
+		}{
+			{"alice", "secret", true},
+			{"alice", "wrong", false},
+			{"bob", "secret", false},
+			{"broken", "secret", false},
+		} {
+			client, err := dial(addr, c.user, ssh.Password(c.password))
+			if err == nil {
+				client.Close()
+			}
+			if (err == nil) != c.ok {
+				t.Errorf("auth %q, %s:%s: expected ok %v, got %v", auth, c.user, c.password, c.ok, err)
+			}
+		}
+	}
+	//keys and the password callback are both required
+	addr := startServer(t, &Config{AuthType: writeAuthorizedKeys(t, key) + "+password", PasswordAuth: check})
+	for _, c := range []struct {
+		name string
+		auth []ssh.AuthMethod
+		ok   bool
+	}{
+		{"key only", []ssh.AuthMethod{ssh.PublicKeys(key)}, false},
+		{"password only", []ssh.AuthMethod{ssh.Password("secret")}, false},
+		{"key and wrong password", []ssh.AuthMethod{ssh.PublicKeys(key), ssh.Password("wrong")}, false},
+		{"key and password", []ssh.AuthMethod{ssh.PublicKeys(key), ssh.Password("secret")}, true},
+	} {
+		client, err := dial(addr, "alice", c.auth...)
+		if err == nil {
+			client.Close()
+		}
+		if (err == nil) != c.ok {
+			t.Errorf("%s: expected ok %v, got %v", c.name, c.ok, err)
+		}
+	}
+}
@@ -1,5 +1,19 @@
 package sshd
 
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
 // Config is the configuration for the server
 type Config struct {
 	Host       string
@@ -11,6 +25,184 @@ type Config struct {
 	KeepAlive  int
 	IgnoreEnv  bool
 	LogVerbose bool
+	// TCPDelay enables Nagle's algorithm on accepted connections.
+	// By default TCP_NODELAY is set, so keystrokes are sent immediately.
+	TCPDelay bool
+	// TCPBufferSize sets the socket read and write buffer sizes
+	// of accepted connections (0 uses the system default)
+	TCPBufferSize int
+	// Term forces the TERM of shells, instead of using
+	// the terminal type requested by the client
+	Term string
+	// SessionMemLimitMB limits the address space of each
+	// session's processes (linux only, 0 is unlimited).
+	//
+	// NOTE: to apply session limits, each shell and command is
+	// started by re-executing the running binary (/proc/self/exe),
+	// which the init of this package intercepts to set the limits
+	// and then execute the command in place. Programs embedding
+	// this package are therefore re-executed for every session:
+	// their binary must remain executable while serving, and the
+	// init of any package initialized before this one also runs.
+	SessionMemLimitMB int
+	// SessionCPUQuota limits the CPU time, in seconds, of each
+	// session's processes (linux only, 0 is unlimited). See the
+	// note on SessionMemLimitMB.
+	SessionCPUQuota int
+	// AuthReloadPolicy decides what happens when the authorized
+	// keys file becomes missing or invalid. "fail-open" (default)
+	// keeps using the last keys, "fail-closed" denies all keys
+	// until the file is valid again.
+	AuthReloadPolicy string
+	// MetricsAddr is the address of an HTTP listener
+	// serving Prometheus metrics at /metrics
+	MetricsAddr string
+	// CopyBufferSize is the buffer size, in bytes, used to copy
+	// session I/O (0 uses the io.Copy default of 32KB)
+	CopyBufferSize int
+	// KeysRefresh is the interval, in seconds, between refreshes
+	// of authorized keys fetched from a URL (defaults to 300).
+	// Keys are refreshed while the server is serving, and an
+	// empty response revokes all keys.
+	KeysRefresh int
+	// KeysCacheFile, if set, stores the last authorized keys fetched
+	// from a URL, for use when the URL is unavailable at startup
+	KeysCacheFile string
+	// KeyboardInteractive, if set, enables keyboard-interactive
+	// authentication, alongside the methods selected by AuthType.
+	// It may pose any challenges to the client (e.g. a TOTP code).
+	// Set AuthType to "keyboard-interactive" to use it alone. When
+	// AuthType requires two factors, it is only offered for the second
+	// (unless named first, e.g. "keyboard-interactive+myuser:mypass").
+	KeyboardInteractive func(user string, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error)
+	// WorkDir is the working directory of sessions
+	// (defaults to the working directory of the server)
+	WorkDir string
+	// UserOverrides replaces the shell, working directory and
+	// environment of specific users, by username.
+	//
+	// WARNING: the username is chosen by the client, and is only
+	// checked by password auth (AuthType "user:pass", PasswordAuth)
+	// and auth callbacks which check it. Public keys (files, github
+	// and URLs) are not bound to usernames, so any key holder may
+	// log in as any user. Do not rely on UserOverrides or UserEnv
+	// to sandbox users unless their usernames are authenticated.
+	UserOverrides map[string]UserConfig
+	// UserEnv forces environment variables ("KEY=value") into
+	// the sessions of specific users, overriding the client's.
+	// See the warning on UserOverrides.
+	UserEnv map[string][]string
+	// MaxConnsPerIP limits the number of new connections from each
+	// source IP within ConnRateWindow, further connections are
+	// dropped before the handshake (0 is unlimited)
+	MaxConnsPerIP int
+	// ConnRateWindow is the MaxConnsPerIP window in seconds (defaults to 60)
+	ConnRateWindow int
+	// AuthorizeConn, if set, is called once a client has authenticated
+	// and before any of its requests are served. Returning an error
+	// closes the connection. The handshake has completed by then, so
+	// the error is only logged: the client is not sent a message, and
+	// only sees the connection close.
+	AuthorizeConn func(user string, perms *ssh.Permissions, remote net.Addr) error
+	// SessionRecordDir, if set, is the directory where the output
+	// of each PTY shell is recorded as an asciinema v2 .cast file
+	SessionRecordDir string
+	// SessionStartTimeout closes session channels which have not
+	// started a shell or command within this many seconds (0 is unlimited)
+	SessionStartTimeout int
+	// MOTD is a message shown at the start of interactive (PTY)
+	// shells. It is never sent to commands, whose output may be
+	// a protocol (e.g. scp), or to shells without a PTY.
+	MOTD string
+	// AgentForwarding allows clients to forward their SSH agent
+	// to sessions, which may then use it via SSH_AUTH_SOCK, unless
+	// their authorized key forbids it (no-agent-forwarding)
+	AgentForwarding bool
+	// Banner is shown to clients before authentication. If it is
+	// the path of a file, the file is shown and reloaded on change.
+	Banner string
+	// X11Forwarding allows clients to forward X11 connections
+	// from sessions, via a local DISPLAY (not supported on windows),
+	// unless their authorized key forbids it (no-x11-forwarding)
+	X11Forwarding bool
+	// AuthLogger receives structured authentication and disconnect
+	// events, for security monitoring (defaults to slog.Default)
+	AuthLogger *slog.Logger
+	// MaxChannelsPerConn limits the number of open channels of each
+	// connection, further channels are rejected (0 is unlimited)
+	MaxChannelsPerConn int
+	// ScrollbackBytes is the amount of recent session output kept
+	// for replay to new session watchers (defaults to 64KB,
+	// negative disables)
+	ScrollbackBytes int
+	// IdleTimeout hangs up PTY shells after this many seconds
+	// without input or output (0 is unlimited)
+	IdleTimeout int
+	// ExecAllowlist, if set, restricts clients to these commands,
+	// all others (and shells) are refused. Entries beginning with
+	// "^" are regular expressions, others are command prefixes
+	// (e.g. "git-receive-pack" or "rsync --server"). Forced commands
+	// (ForceCommand, or a key's command="...") are not restricted,
+	// they run in place of the client's command and may check it.
+	ExecAllowlist []string
+	// ForceCommand, if set, is run in place of every shell and
+	// command. The client's command is set as SSH_ORIGINAL_COMMAND.
+	ForceCommand string
+	// AuditWriter, if set, receives a JSON line for each command
+	// (including forced commands and commands run in a pty) once it
+	// exits, with its user, remote address, exit code and duration.
+	// Shells and commands refused by the ExecAllowlist are written
+	// when refused, with "rejected" set. It is written independently
+	// of the server logs.
+	AuditWriter io.Writer
+	// ConnectionFilter, if set, is called with each new connection
+	// before the handshake. Returning an error closes the connection.
+	// Connections are filtered concurrently, so a slow filter (e.g. a
+	// remote blocklist) does not delay other connections.
+	ConnectionFilter func(conn net.Conn) error
+	// EventHook, if set, is called synchronously with server events
+	// and their attributes: "connected", "auth.success", "auth.failure",
+	// "session.started", "session.ended", "pty.requested", "pty.resized",
+	// "forward.requested" and "disconnected". It should not block.
+	EventHook func(event string, attrs map[string]string)
+	// KeyPEM is a PEM encoded private host key, taking
+	// precedence over KeyFile and KeySeed
+	KeyPEM string
+	// KeepAliveMaxMissed is the number of unanswered connection
+	// keep alives, sent every KeepAlive seconds, after which the
+	// connection is closed (defaults to 3)
+	KeepAliveMaxMissed int
+	// PasswordAuth, if set, validates passwords (e.g. against bcrypt
+	// hashes or a database) instead of the username and password of
+	// AuthType. Set AuthType to "password" (or leave it empty) to use
+	// it alone, or to "<keys>+password" to require both.
+	PasswordAuth func(user, password string, remote net.Addr) (bool, error)
+	// MaxAuthTries is the number of failed authentication attempts
+	// after which a connection is dropped (defaults to 6, negative
+	// is unlimited)
+	MaxAuthTries int
+	// Listen is a list of addresses ("host:port") to listen on,
+	// in place of Host and Port
+	Listen []string
+	// KeyType is the type of generated host keys, "ed25519"
+	// or "rsa", used when no KeyFile or KeyPEM is set. Defaults
+	// to "ed25519", or "rsa" when KeySeed is set
+	KeyType string
+	// MaxOutputBytesPerSec limits the output rate of each session's
+	// shell or command, pausing it when exceeded (0 is unlimited)
+	MaxOutputBytesPerSec int
+	// HealthCheckAddr is the address of an HTTP listener responding
+	// "OK" to any request, without an SSH handshake, for use as
+	// a load balancer liveness probe
+	HealthCheckAddr string
+}
+
+// UserConfig overrides the session settings of a user
+type UserConfig struct {
+	Shell   string
+	WorkDir string
+	// Env is applied after Config.UserEnv
+	Env []string
 }
 
 // NewConfig creates a new Config
@@ -20,3 +212,23 @@ func NewConfig(keyFile string, keySeed string) *Config {
 		KeySeed: keySeed,
 	}
 }
+
+// LoadConfig decodes the JSON or YAML file at path into c.
+// Keys are the lowercased field names (e.g. "keyfile"), and
+// fields missing from the file are left unchanged.
+func LoadConfig(path string, c *Config) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(b, c)
+	default:
+		err = yaml.Unmarshal(b, c)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package sshd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	want := Config{
+		Host:          "127.0.0.1",
+		Port:          "2022",
+		Shell:         "/bin/sh",
+		KeyFile:       "/etc/ssh/host_key",
+		AuthType:      "foo:bar",
+		KeepAlive:     30,
+		IgnoreEnv:     true,
+		Listen:        []string{"127.0.0.1:2022", "[::1]:2022"},
+		ExecAllowlist: []string{"git-upload-pack", "^rsync --server .*$"},
+		IdleTimeout:   600,
+		MOTD:          "welcome",
+		UserOverrides: map[string]UserConfig{"deploy": {Shell: "/bin/bash", WorkDir: "/srv"}},
+		UserEnv:       map[string][]string{"deploy": {"ROLE=deploy"}},
+		//left unchanged by the files
+		KeyType: "rsa",
+	}
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"config.yaml": `
+host: 127.0.0.1
+port: "2022"
+shell: /bin/sh
+keyfile: /etc/ssh/host_key
+authtype: foo:bar
+keepalive: 30
+ignoreenv: true
+listen: ["127.0.0.1:2022", "[::1]:2022"]
+execallowlist:
+  - git-upload-pack
+  - ^rsync --server .*$
+idletimeout: 600
+motd: welcome
+useroverrides:
+  deploy: {shell: /bin/bash, workdir: /srv}
+userenv:
+  deploy: [ROLE=deploy]
+`,
+		"config.json": `{
+	"host": "127.0.0.1",
+	"port": "2022",
+	"shell": "/bin/sh",
+	"keyfile": "/etc/ssh/host_key",
+	"authtype": "foo:bar",
+	"keepalive": 30,
+	"ignoreenv": true,
+	"listen": ["127.0.0.1:2022", "[::1]:2022"],
+	"execallowlist": ["git-upload-pack", "^rsync --server .*$"],
+	"idletimeout": 600,
+	"motd": "welcome",
+	"useroverrides": {"deploy": {"shell": "/bin/bash", "workdir": "/srv"}},
+	"userenv": {"deploy": ["ROLE=deploy"]}
+}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		c := Config{KeyType: "rsa", KeepAlive: 60}
+		if err := LoadConfig(path, &c); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !reflect.DeepEqual(c, want) {
+			t.Errorf("%s: got %+v, want %+v", name, c, want)
+		}
+	}
+	//invalid files are reported
+	path := filepath.Join(dir, "invalid.json")
+	os.WriteFile(path, []byte("{"), 0600)
+	if err := LoadConfig(path, &Config{}); err == nil {
+		t.Error("expected an error for an invalid file")
+	}
+}
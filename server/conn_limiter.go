@@ -0,0 +1,65 @@
+package sshd
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// connLimiter limits the number of new connections
+// from each source IP, within a fixed time window
+type connLimiter struct {
+	max    int
+	window time.Duration
+	mut    sync.Mutex
+	counts map[string]*connCount
+	swept  time.Time
+}
+
+type connCount struct {
+	start time.Time
+	n     int
+}
+
+func newConnLimiter(max int, window time.Duration) *connLimiter {
+	return &connLimiter{
+		max:    max,
+		window: window,
+		counts: map[string]*connCount{},
+	}
+}
+
+// allow records a new connection from ip, and reports
+// whether it is within the limit
+func (cl *connLimiter) allow(ip string, now time.Time) bool {
+	cl.mut.Lock()
+	defer cl.mut.Unlock()
+	//evict expired windows, at most once per window
+	if now.Sub(cl.swept) >= cl.window {
+		for k, c := range cl.counts {
+			if now.Sub(c.start) >= cl.window {
+				delete(cl.counts, k)
+			}
+		}
+		cl.swept = now
+	}
+	c, ok := cl.counts[ip]
+	if !ok || now.Sub(c.start) >= cl.window {
+		c = &connCount{start: now}
+		cl.counts[ip] = c
+	}
+	c.n++
+	return c.n <= cl.max
+}
+
+// remoteIP returns the IP of the given address,
+// or the whole address if it has no IP
+func remoteIP(addr net.Addr) string {
+	if ta, ok := addr.(*net.TCPAddr); ok {
+		return ta.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
@@ -0,0 +1,29 @@
+package sshd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnLimiter(t *testing.T) {
+	cl := newConnLimiter(2, time.Minute)
+	now := time.Now()
+	for i, want := range []bool{true, true, false, false} {
+		if got := cl.allow("10.0.0.1", now); got != want {
+			t.Errorf("connection %d: expected %v", i+1, want)
+		}
+	}
+	//other addresses have their own count
+	if !cl.allow("10.0.0.2", now) {
+		t.Error("expected another address to be allowed")
+	}
+	//and counts reset once the window has passed
+	if !cl.allow("10.0.0.1", now.Add(time.Minute)) {
+		t.Error("expected a new window to be allowed")
+	}
+	//expired windows are evicted
+	cl.allow("10.0.0.3", now.Add(3*time.Minute))
+	if n := len(cl.counts); n != 1 {
+		t.Errorf("expected 1 address left, got %d", n)
+	}
+}
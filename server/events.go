@@ -0,0 +1,17 @@
+package sshd
+
+import "fmt"
+
+// event calls the EventHook, if any, with the given
+// attributes (alternating keys and values)
+func (s *Server) event(name string, attrs ...any) {
+	hook := s.cli.EventHook
+	if hook == nil {
+		return
+	}
+	m := map[string]string{}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		m[fmt.Sprint(attrs[i])] = fmt.Sprint(attrs[i+1])
+	}
+	hook(name, m)
+}
@@ -0,0 +1,85 @@
+package sshd
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type hookEvent struct {
+	name  string
+	attrs map[string]string
+}
+
+// eventHook returns an EventHook, and a func
+// which waits for the next event of a name
+func eventHook(t *testing.T) (func(string, map[string]string), func(string) map[string]string) {
+	events := make(chan hookEvent, 100)
+	hook := func(name string, attrs map[string]string) {
+		events <- hookEvent{name, attrs}
+	}
+	next := func(name string) map[string]string {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case e := <-events:
+				if e.name == name {
+					return e.attrs
+				}
+			case <-timeout:
+				t.Fatalf("missing %s event", name)
+			}
+		}
+	}
+	return hook, next
+}
+
+func TestEventHook(t *testing.T) {
+	hook, next := eventHook(t)
+	client, err := dial(startServer(t, &Config{AuthType: "foo:bar", EventHook: hook}), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if e := next("connected"); e["user"] != "foo" || e["remote_ip"] != "127.0.0.1" || e["client_version"] == "" {
+		t.Errorf("unexpected connected event %v", e)
+	}
+	if _, err := run(t, client, "echo ok"); err != nil {
+		t.Fatal(err)
+	}
+	e := next("session.started")
+	if e["user"] != "foo" || e["type"] != "exec" || e["command"] != "echo ok" || e["session"] == "" {
+		t.Errorf("unexpected session.started event %v", e)
+	}
+	if ended := next("session.ended"); ended["session"] != e["session"] {
+		t.Errorf("unexpected session.ended event %v", ended)
+	}
+}
+
+func TestPtyEvents(t *testing.T) {
+	hook, next := eventHook(t)
+	client, err := dial(startServer(t, &Config{AuthType: "foo:bar", EventHook: hook}), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := sess.RequestPty("vt100", 24, 80, nil); err != nil {
+		t.Fatal(err)
+	}
+	if e := next("pty.requested"); e["term"] != "vt100" || e["cols"] != "80" || e["rows"] != "24" {
+		t.Errorf("unexpected pty.requested event %v", e)
+	}
+	if err := sess.WindowChange(50, 132); err != nil {
+		t.Fatal(err)
+	}
+	if e := next("pty.resized"); e["cols"] != "132" || e["rows"] != "50" || e["user"] != "foo" {
+		t.Errorf("unexpected pty.resized event %v", e)
+	}
+}
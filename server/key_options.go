@@ -0,0 +1,102 @@
+package sshd
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// forceCommandExtension holds the command="..." option
+// of the authorized key a connection authenticated with
+const forceCommandExtension = "force-command"
+
+// noAgentForwardingExtension and noX11ForwardingExtension are set
+// when the authorized key a connection authenticated with forbids
+// agent and X11 forwarding
+const (
+	noAgentForwardingExtension = "no-agent-forwarding"
+	noX11ForwardingExtension   = "no-x11-forwarding"
+)
+
+// keyPermissions applies the options of an authorized key.
+// from="pattern-list" restricts the client address, and
+// command="..." forces the command of each session.
+// no-agent-forwarding and no-x11-forwarding forbid agent and
+// X11 forwarding, as does restrict, unless followed by
+// agent-forwarding or x11-forwarding. Other options are ignored.
+func keyPermissions(opts []string, remote net.Addr) (*ssh.Permissions, error) {
+	perms := &ssh.Permissions{Extensions: map[string]string{}}
+	for _, o := range opts {
+		name, value, _ := strings.Cut(o, "=")
+		value = unquoteOption(value)
+		switch strings.ToLower(name) {
+		case "from":
+			if ip := remoteIP(remote); !matchFrom(value, ip) {
+				return nil, fmt.Errorf("denied from %s", ip)
+			}
+		case "command":
+			perms.Extensions[forceCommandExtension] = value
+		case "restrict":
+			perms.Extensions[noAgentForwardingExtension] = ""
+			perms.Extensions[noX11ForwardingExtension] = ""
+		case "no-agent-forwarding":
+			perms.Extensions[noAgentForwardingExtension] = ""
+		case "agent-forwarding":
+			delete(perms.Extensions, noAgentForwardingExtension)
+		case "no-x11-forwarding":
+			perms.Extensions[noX11ForwardingExtension] = ""
+		case "x11-forwarding":
+			delete(perms.Extensions, noX11ForwardingExtension)
+		}
+	}
+	return perms, nil
+}
+
+// keyForbids reports whether the authorized key the connection
+// of the session authenticated with has the given restriction
+func keyForbids(sess *session, extension string) bool {
+	if perms := sess.conn.Permissions; perms != nil {
+		_, ok := perms.Extensions[extension]
+		return ok
+	}
+	return false
+}
+
+func unquoteOption(v string) string {
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		v = strings.ReplaceAll(v[1:len(v)-1], `\"`, `"`)
+	}
+	return v
+}
+
+// matchFrom reports whether the ip matches the comma separated
+// patterns of a from= option. Patterns are addresses, CIDRs or
+// wildcards ("10.0.*"), and are negated by a leading "!".
+// Hostnames are not resolved.
+func matchFrom(patterns, ip string) bool {
+	matched := false
+	for _, p := range strings.Split(patterns, ",") {
+		p = strings.TrimSpace(p)
+		negate := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		if matchAddr(p, ip) {
+			if negate {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+func matchAddr(pattern, ip string) bool {
+	if strings.Contains(pattern, "/") {
+		_, n, err := net.ParseCIDR(pattern)
+		return err == nil && n.Contains(net.ParseIP(ip))
+	}
+	ok, _ := path.Match(pattern, ip)
+	return ok
+}
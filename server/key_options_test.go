@@ -0,0 +1,76 @@
+package sshd
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMatchFrom(t *testing.T) {
+	for _, tc := range []struct {
+		patterns, ip string
+		want         bool
+	}{
+		{"127.0.0.1", "127.0.0.1", true},
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "127.0.0.1", false},
+		{"10.0.*", "10.0.9.9", true},
+		{"10.0.*,!10.0.0.1", "10.0.0.1", false},
+		{"!10.0.0.1,10.0.*", "10.0.0.2", true},
+		{"!10.0.0.1", "10.0.0.2", false},
+	} {
+		if got := matchFrom(tc.patterns, tc.ip); got != tc.want {
+			t.Errorf("matchFrom(%q, %q) = %v, want %v", tc.patterns, tc.ip, got, tc.want)
+		}
+	}
+}
+
+// authorizedKey is an authorized keys line for the signer, with options
+func authorizedKey(opts string, signer ssh.Signer) string {
+	return opts + " " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+}
+
+func TestKeyOptions(t *testing.T) {
+	forced, local, remote, plain := newSigner(t), newSigner(t), newSigner(t), newSigner(t)
+	keys := writeAuthorizedKeys(t,
+		authorizedKey(`command="echo forced"`, forced),
+		authorizedKey(`from="127.0.0.0/8"`, local),
+		authorizedKey(`from="10.0.0.0/8"`, remote),
+		plain,
+	)
+	for name, auth := range map[string]string{
+		"keys":          keys,
+		"keys+password": keys + "+foo:bar",
+	} {
+		addr := startServer(t, &Config{AuthType: auth})
+		login := func(key ssh.Signer) (*ssh.Client, error) {
+			return dial(addr, "foo", ssh.PublicKeys(key), ssh.Password("bar"))
+		}
+		t.Run(name, func(t *testing.T) {
+			for _, tc := range []struct {
+				name string
+				key  ssh.Signer
+				want string
+			}{
+				{"command", forced, "forced\n"},
+				{"from match", local, "chosen\n"},
+				{"no options", plain, "chosen\n"},
+			} {
+				client, err := login(tc.key)
+				if err != nil {
+					t.Fatalf("%s: %s", tc.name, err)
+				}
+				out, err := run(t, client, "echo chosen")
+				client.Close()
+				if err != nil || out != tc.want {
+					t.Errorf("%s: got %q (%v), want %q", tc.name, out, err, tc.want)
+				}
+			}
+			if client, err := login(remote); err == nil {
+				client.Close()
+				t.Error("from mismatch: expected authentication to fail")
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package sshd
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -12,50 +13,142 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
-func generateKey(seed string) ([]byte, error) {
-	var r io.Reader
+// seededKeys caches keys generated from a seed, which are
+// deterministic and slow to generate, by key type and seed
+var seededKeys = struct {
+	sync.Mutex
+	pems map[string][]byte
+}{pems: map[string][]byte{}}
+
+// generateKey generates a PEM encoded private key of the given
+// type ("ed25519" or "rsa"), from the seed if set
+func generateKey(keyType, seed string) ([]byte, error) {
 	if seed == "" {
-		r = rand.Reader
-	} else {
-		r = newDetermRand([]byte(seed))
+		return generateKeyFrom(keyType, rand.Reader)
 	}
-	priv, err := rsa.GenerateKey(r, 2048)
-	if err != nil {
-		return nil, err
+	seededKeys.Lock()
+	defer seededKeys.Unlock()
+	id := keyType + ":" + seed
+	if b, ok := seededKeys.pems[id]; ok {
+		return b, nil
 	}
-	err = priv.Validate()
+	b, err := generateKeyFrom(keyType, newDetermRand([]byte(seed)))
 	if err != nil {
 		return nil, err
 	}
-	b := x509.MarshalPKCS1PrivateKey(priv)
-	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: b}), nil
+	seededKeys.pems[id] = b
+	return b, nil
 }
 
-func githubKeys(user string) (map[string]string, error) {
-	resp, err := http.Get("https://github.com/" + user + ".keys")
+func generateKeyFrom(keyType string, r io.Reader) ([]byte, error) {
+	switch keyType {
+	case "ed25519":
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := io.ReadFull(r, seed); err != nil {
+			return nil, err
+		}
+		b, err := x509.MarshalPKCS8PrivateKey(ed25519.NewKeyFromSeed(seed))
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), nil
+	case "rsa":
+		priv, err := rsa.GenerateKey(r, 2048)
+		if err != nil {
+			return nil, err
+		}
+		err = priv.Validate()
+		if err != nil {
+			return nil, err
+		}
+		b := x509.MarshalPKCS1PrivateKey(priv)
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: b}), nil
+	}
+	return nil, fmt.Errorf("unknown key type: %s", keyType)
+}
+
+var keysClient = &http.Client{Timeout: 30 * time.Second}
+
+// fetchKeys fetches and parses the authorized keys at url,
+// returning the keys and the raw response body
+func fetchKeys(url string) (map[string]AuthorizedKey, []byte, error) {
+	resp, err := keysClient.Get(url)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch github user keys: %w", err)
+		return nil, nil, fmt.Errorf("failed to fetch keys: %w", err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("failed to fetch keys: %s", resp.Status)
+	}
 	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys, err := parseFetchedKeys(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, b, nil
+}
+
+// parseFetchedKeys parses keys fetched from a URL (or its cache).
+// Unlike keys files, an empty list is valid, so revoking every
+// key at the source takes effect.
+func parseFetchedKeys(b []byte) (map[string]AuthorizedKey, error) {
+	for _, l := range bytes.Split(b, []byte("\n")) {
+		if l = bytes.TrimSpace(l); len(l) > 0 && l[0] != '#' {
+			return parseKeys(b)
+		}
+	}
+	return map[string]AuthorizedKey{}, nil
+}
+
+func githubKeysURL(user string) string {
+	return "https://github.com/" + user + ".keys"
+}
+
+// AuthorizedKey is a public key trusted by an auth source
+type AuthorizedKey struct {
+	Key     ssh.PublicKey
+	Comment string
+	// Options restrict the key (e.g. `from="10.0.0.0/8"`)
+	Options []string
+}
+
+// LoadAuthorizedKeys loads the keys of a key based auth source:
+// a github user ("github.com/myuser"), an http(s) URL, or
+// otherwise, the path of an authorized keys file
+func LoadAuthorizedKeys(auth string) ([]AuthorizedKey, error) {
+	var b []byte
+	var err error
+	if strings.HasPrefix(auth, "github.com/") {
+		_, b, err = fetchKeys(githubKeysURL(strings.TrimPrefix(auth, "github.com/")))
+	} else if strings.HasPrefix(auth, "https://") || strings.HasPrefix(auth, "http://") {
+		_, b, err = fetchKeys(auth)
+	} else {
+		b, err = os.ReadFile(auth)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return parseKeys(b)
+	return parseKeyList(b)
 }
 
-func parseKeys(b []byte) (map[string]string, error) {
+func parseKeyList(b []byte) ([]AuthorizedKey, error) {
 	lines := bytes.Split(b, []byte("\n"))
 	//parse each line
-	keys := map[string]string{}
+	keys := []AuthorizedKey{}
 	for _, l := range lines {
-		if key, cmt, _, _, err := ssh.ParseAuthorizedKey(l); err == nil {
-			keys[string(key.Marshal())] = cmt
+		if key, cmt, opts, _, err := ssh.ParseAuthorizedKey(l); err == nil {
+			keys = append(keys, AuthorizedKey{Key: key, Comment: cmt, Options: opts})
 		}
 	}
 	//ensure we got something
@@ -65,7 +158,26 @@ func parseKeys(b []byte) (map[string]string, error) {
 	return keys, nil
 }
 
-func fingerprint(k ssh.PublicKey) string {
+func parseKeys(b []byte) (map[string]AuthorizedKey, error) {
+	list, err := parseKeyList(b)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]AuthorizedKey{}
+	for _, k := range list {
+		keys[string(k.Key.Marshal())] = k
+	}
+	return keys, nil
+}
+
+// keyTypeName is the short name of the type of the given
+// key (e.g. "RSA" for "ssh-rsa", "ED25519" for "ssh-ed25519")
+func keyTypeName(k ssh.PublicKey) string {
+	return strings.ToUpper(strings.TrimPrefix(k.Type(), "ssh-"))
+}
+
+// Fingerprint returns the SHA256 fingerprint of the given key
+func Fingerprint(k ssh.PublicKey) string {
 	bytes := sha256.Sum256(k.Marshal())
 	b64 := base64.StdEncoding.EncodeToString(bytes[:])
 	if strings.HasSuffix(b64, "=") {
@@ -0,0 +1,230 @@
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKey dials addr and returns the host key it presents
+func hostKey(t *testing.T, addr string) ssh.PublicKey {
+	t.Helper()
+	var key ssh.PublicKey
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "foo",
+		Auth: []ssh.AuthMethod{ssh.Password("bar")},
+		HostKeyCallback: func(_ string, _ net.Addr, k ssh.PublicKey) error {
+			key = k
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	return key
+}
+
+func TestSeededHostKeyType(t *testing.T) {
+	for _, c := range []struct {
+		seed, keyType, want string
+	}{
+		{"", "", ssh.KeyAlgoED25519},
+		{"", "rsa", ssh.KeyAlgoRSA},
+		//seeded deployments keep their earlier rsa keys
+		{"foo", "", ssh.KeyAlgoRSA},
+		{"foo", "ed25519", ssh.KeyAlgoED25519},
+	} {
+		addr := startServer(t, &Config{AuthType: "foo:bar", KeySeed: c.seed, KeyType: c.keyType})
+		if got := hostKey(t, addr).Type(); got != c.want {
+			t.Errorf("seed %q type %q: expected %s, got %s", c.seed, c.keyType, c.want, got)
+		}
+	}
+	//and the same seed gives the same key
+	a := hostKey(t, startServer(t, &Config{AuthType: "foo:bar", KeySeed: "foo"}))
+	b := hostKey(t, startServer(t, &Config{AuthType: "foo:bar", KeySeed: "foo", KeyType: "rsa"}))
+	if !bytes.Equal(a.Marshal(), b.Marshal()) {
+		t.Error("expected the same seeded key")
+	}
+}
+
+func TestSeededKeyCache(t *testing.T) {
+	for _, keyType := range []string{"rsa", "ed25519"} {
+		a, err := generateKey(keyType, "cache")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := generateKey(keyType, "cache")
+		if err != nil {
+			t.Fatal(err)
+		}
+		//the same key, and not generated again
+		if &a[0] != &b[0] {
+			t.Errorf("%s: expected a cached key", keyType)
+		}
+		//but keys without a seed are never cached
+		c, _ := generateKey(keyType, "")
+		d, _ := generateKey(keyType, "")
+		if bytes.Equal(c, d) {
+			t.Errorf("%s: expected random keys", keyType)
+		}
+	}
+	a, _ := generateKey("ed25519", "cache")
+	b, _ := generateKey("ed25519", "other")
+	if bytes.Equal(a, b) {
+		t.Error("expected keys of other seeds to differ")
+	}
+}
+
+func TestURLKeys(t *testing.T) {
+	a, b := newSigner(t), newSigner(t)
+	var mut sync.Mutex
+	var body []byte
+	fetches := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		defer mut.Unlock()
+		fetches++
+		w.Write(body)
+	}))
+	defer ts.Close()
+	setKeys := func(b []byte) {
+		mut.Lock()
+		body = b
+		mut.Unlock()
+	}
+	login := func(addr string, key ssh.Signer) bool {
+		client, err := dial(addr, "foo", ssh.PublicKeys(key))
+		if err == nil {
+			client.Close()
+		}
+		return err == nil
+	}
+	//wait for a refresh, which happens every second
+	refreshed := func() {
+		mut.Lock()
+		n := fetches
+		mut.Unlock()
+		for i := 0; i < 30; i++ {
+			time.Sleep(100 * time.Millisecond)
+			mut.Lock()
+			done := fetches > n
+			mut.Unlock()
+			if done {
+				//let the refresh apply its keys
+				time.Sleep(100 * time.Millisecond)
+				return
+			}
+		}
+		t.Fatal("keys not refreshed")
+	}
+	setKeys(ssh.MarshalAuthorizedKey(a.PublicKey()))
+	cache := filepath.Join(t.TempDir(), "keys")
+	c := &Config{AuthType: ts.URL, KeysRefresh: 1, KeysCacheFile: cache}
+	s, err := NewServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.StartWithContext(ctx, l)
+		close(stopped)
+	}()
+	addr := l.Addr().String()
+	if !login(addr, a) || login(addr, b) {
+		t.Fatal("expected only the first key")
+	}
+	//refreshes apply updates...
+	setKeys(ssh.MarshalAuthorizedKey(b.PublicKey()))
+	refreshed()
+	if login(addr, a) || !login(addr, b) {
+		t.Fatal("expected only the updated key")
+	}
+	//...and revoking every key
+	setKeys([]byte("# no keys\n"))
+	refreshed()
+	if login(addr, a) || login(addr, b) {
+		t.Fatal("expected all keys to be revoked")
+	}
+	//refreshes stop with the server
+	setKeys(ssh.MarshalAuthorizedKey(b.PublicKey()))
+	refreshed()
+	cancel()
+	<-stopped
+	mut.Lock()
+	n := fetches
+	mut.Unlock()
+	time.Sleep(1500 * time.Millisecond)
+	mut.Lock()
+	if fetches != n {
+		t.Error("keys refreshed after the server stopped")
+	}
+	mut.Unlock()
+	//and the cache is used when the source is down at startup
+	ts.Close()
+	if !login(startServer(t, &Config{AuthType: ts.URL, KeysCacheFile: cache}), b) {
+		t.Error("expected the cached key")
+	}
+}
+
+// newKeyPEM returns a new host key, and its PEM encoding
+func newKeyPEM(t *testing.T) (ssh.Signer, string) {
+	t.Helper()
+	_, pri, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(pri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(pri, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, string(pem.EncodeToMemory(block))
+}
+
+func TestKeyPEM(t *testing.T) {
+	pemKey, keyPEM := newKeyPEM(t)
+	fileKey, filePEM := newKeyPEM(t)
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, []byte(filePEM), 0600); err != nil {
+		t.Fatal(err)
+	}
+	//PEM keys take precedence over key files and seeds
+	for _, c := range []struct {
+		config Config
+		want   ssh.Signer
+	}{
+		{Config{KeyPEM: keyPEM}, pemKey},
+		{Config{KeyPEM: keyPEM, KeyFile: keyFile, KeySeed: "seed"}, pemKey},
+		{Config{KeyFile: keyFile}, fileKey},
+	} {
+		config := c.config
+		config.AuthType = "foo:bar"
+		if got, want := Fingerprint(hostKey(t, startServer(t, &config))), Fingerprint(c.want.PublicKey()); got != want {
+			t.Errorf("%+v: got host key %s, want %s", c.config, got, want)
+		}
+	}
+	if _, err := NewServer(&Config{AuthType: "foo:bar", KeyPEM: "not a key"}); err == nil {
+		t.Error("expected an invalid PEM key to fail")
+	}
+}
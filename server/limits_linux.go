@@ -0,0 +1,102 @@
+//go:build linux
+
+package sshd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// limitsEnv marks a command re-executed through this binary, holding
+// the limits to apply ("<address space> <cpu seconds> <path>") before
+// the command itself is executed
+const limitsEnv = "_SSHD_LITE_LIMITS"
+
+func init() {
+	v, ok := os.LookupEnv(limitsEnv)
+	if !ok {
+		return
+	}
+	os.Unsetenv(limitsEnv)
+	if err := execLimited(v); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start session (%s)\n", err)
+		os.Exit(126)
+	}
+}
+
+// limitCommand applies the configured session resource limits to
+// the given (not yet started) command. The command is re-executed
+// through this binary, which sets the limits and then executes the
+// command in place, so the limits apply from its very first
+// instruction, and are inherited by any children it forks.
+func (s *Server) limitCommand(cmd *exec.Cmd) error {
+	mb, secs := s.cli.SessionMemLimitMB, s.cli.SessionCPUQuota
+	if mb <= 0 && secs <= 0 {
+		return nil
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	var as uint64
+	if mb > 0 {
+		as = uint64(mb) << 20
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d %d %s", limitsEnv, as, max(secs, 0), cmd.Path))
+	cmd.Path = "/proc/self/exe"
+	return nil
+}
+
+func execLimited(v string) error {
+	f := strings.SplitN(v, " ", 3)
+	if len(f) != 3 {
+		return fmt.Errorf("invalid limits: %s", v)
+	}
+	as, err := strconv.ParseUint(f[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	secs, err := strconv.ParseUint(f[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	//nothing may be allocated once the address space is limited,
+	//the runtime would fail to grow its heap, so prepare the exec
+	argv, err := syscall.SlicePtrFromStrings(os.Args)
+	if err != nil {
+		return err
+	}
+	envv, err := syscall.SlicePtrFromStrings(os.Environ())
+	if err != nil {
+		return err
+	}
+	path, err := syscall.BytePtrFromString(f[2])
+	if err != nil {
+		return err
+	}
+	debug.SetGCPercent(-1)
+	if secs > 0 {
+		if err := unix.Setrlimit(unix.RLIMIT_CPU, &unix.Rlimit{Cur: secs, Max: secs}); err != nil {
+			return fmt.Errorf("failed to set cpu limit: %w", err)
+		}
+	}
+	if as > 0 {
+		lim := unix.Rlimit{Cur: as, Max: as}
+		_, _, errno := unix.RawSyscall6(unix.SYS_PRLIMIT64, 0, unix.RLIMIT_AS, uintptr(unsafe.Pointer(&lim)), 0, 0, 0)
+		if errno != 0 {
+			return fmt.Errorf("failed to set memory limit: %w", errno)
+		}
+	}
+	_, _, errno := unix.RawSyscall(unix.SYS_EXECVE,
+		uintptr(unsafe.Pointer(path)),
+		uintptr(unsafe.Pointer(&argv[0])),
+		uintptr(unsafe.Pointer(&envv[0])))
+	return errno
+}
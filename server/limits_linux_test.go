@@ -0,0 +1,84 @@
+//go:build linux
+
+package sshd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSessionLimits(t *testing.T) {
+	addr := startServer(t, &Config{
+		AuthType:          "foo:bar",
+		SessionMemLimitMB: 512,
+		SessionCPUQuota:   30,
+	})
+	client, err := dial(addr, "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	//the limits must apply before the command runs, so
+	//children forked right away are also limited
+	command := "grep -E 'Max (address space|cpu time)' /proc/self/limits; true"
+	for i := 0; i < 20; i++ {
+		out, err := run(t, client, command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out, "536870912") || !strings.Contains(out, "30 ") {
+			t.Fatalf("run %d: limits not applied:\n%s", i, out)
+		}
+	}
+	//and to shells
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := sess.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	sess.Stdout = &out
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	stdin.Write([]byte("grep 'Max address space' /proc/$$/limits; exit\n"))
+	sess.Wait()
+	if !strings.Contains(out.String(), "536870912") {
+		t.Fatalf("shell limits not applied:\n%s", out.String())
+	}
+}
+
+func TestSessionLimitsEnforced(t *testing.T) {
+	addr := startServer(t, &Config{
+		AuthType:          "foo:bar",
+		SessionMemLimitMB: 64,
+		SessionCPUQuota:   1,
+	})
+	client, err := dial(addr, "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	//the shell fails to grow past the memory limit
+	out, err := run(t, client, `x=$(head -c 200000000 /dev/zero | tr '\0' a); echo survived`)
+	if err == nil || strings.Contains(out, "survived") {
+		t.Errorf("expected the memory limit to end the command, got %v: %q", err, out)
+	}
+	//and a busy loop is killed once its cpu time is used
+	//(with SIGKILL, as the soft and hard limits are equal)
+	_, err = run(t, client, "while :; do :; done")
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || (exitErr.Signal() != "KILL" && exitErr.Signal() != "XCPU") {
+		t.Errorf("expected the cpu limit to kill the command, got %v", err)
+	}
+}
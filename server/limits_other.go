@@ -0,0 +1,17 @@
+//go:build !linux
+
+package sshd
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// limitCommand fails when session resource limits are
+// configured, since they are only supported on linux
+func (s *Server) limitCommand(cmd *exec.Cmd) error {
+	if s.cli.SessionMemLimitMB > 0 || s.cli.SessionCPUQuota > 0 {
+		return fmt.Errorf("session resource limits are only supported on linux")
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// process wraps a started command and ensures it is
+// waited on exactly once, recording its exit state
+type process struct {
+	cmd   *exec.Cmd
+	done  chan struct{}
+	state *os.ProcessState
+	err   error
+}
+
+// reap begins waiting on the (already started) command
+func reap(cmd *exec.Cmd) *process {
+	p := &process{
+		cmd:  cmd,
+		done: make(chan struct{}),
+	}
+	go func() {
+		err := cmd.Wait()
+		//non-zero exit codes are not wait failures
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			err = nil
+		}
+		p.state = cmd.ProcessState
+		p.err = err
+		close(p.done)
+	}()
+	return p
+}
+
+// wait blocks until the process has exited, and returns
+// its exit state. it is safe to call wait multiple times.
+func (p *process) wait() (*os.ProcessState, error) {
+	<-p.done
+	return p.state, p.err
+}
+
+// signal sends the given SSH signal (e.g. "INT") to the process,
+// and the other processes of its group
+func (p *process) signal(name string) error {
+	sig, ok := signals[name]
+	if !ok {
+		return fmt.Errorf("unknown signal: %s", name)
+	}
+	select {
+	case <-p.done:
+		return fmt.Errorf("process exited")
+	default:
+	}
+	return signalGroup(p.cmd.Process, sig)
+}
+
+// exitRequest waits for the process to exit, and then returns the
+// "exit-signal" or "exit-status" channel request describing its exit
+func (p *process) exitRequest() (string, []byte) {
+	state, _ := p.wait()
+	if state == nil {
+		return "exit-status", ssh.Marshal(exitStatus{Status: 255})
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		if name, ok := signalName(ws.Signal()); ok {
+			return "exit-signal", ssh.Marshal(exitSignal{
+				Signal:     name,
+				CoreDumped: ws.CoreDump(),
+			})
+		}
+		//unnamed signals are reported the way shells do
+		return "exit-status", ssh.Marshal(exitStatus{Status: 128 + uint32(ws.Signal())})
+	}
+	return "exit-status", ssh.Marshal(exitStatus{Status: uint32(state.ExitCode())})
+}
+
+type exitStatus struct {
+	Status uint32
+}
+
+type exitSignal struct {
+	Signal     string
+	CoreDumped bool
+	Message    string
+	Lang       string
+}
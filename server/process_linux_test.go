@@ -0,0 +1,72 @@
+//go:build linux
+
+package sshd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// zombies lists the exited, but unreaped, children of this process
+func zombies(t *testing.T) []string {
+	t.Helper()
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := []string{}
+	for _, path := range stats {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			continue //exited
+		}
+		//pid (comm) state ppid ...
+		i := strings.LastIndexByte(string(b), ')')
+		f := strings.Fields(string(b[i+1:]))
+		if len(f) > 1 && f[0] == "Z" && f[1] == fmt.Sprint(os.Getpid()) {
+			list = append(list, string(b[:i+1]))
+		}
+	}
+	return list
+}
+
+func TestManyExecsReaped(t *testing.T) {
+	//forced commands run in a pty when one is requested
+	for _, force := range []string{"", "echo $SSH_ORIGINAL_COMMAND"} {
+		addr := startServer(t, &Config{AuthType: "foo:bar", ForceCommand: force})
+		client, err := dial(addr, "foo", ssh.Password("bar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		for i := 0; i < 20; i++ {
+			sess, err := client.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i%2 == 0 {
+				if err := sess.RequestPty("xterm", 24, 80, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if out, err := sess.Output(fmt.Sprintf("echo %d", i)); err != nil || !strings.Contains(string(out), fmt.Sprint(i)) {
+				t.Fatalf("run %d: unexpected output %q (%v)", i, out, err)
+			}
+			sess.Close()
+		}
+	}
+	//reaping may lag the exit status slightly
+	deadline := time.Now().Add(2 * time.Second)
+	for z := zombies(t); len(z) > 0; z = zombies(t) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d zombie processes: %v", len(z), z)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,66 @@
+//go:build !windows
+
+package sshd
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSignalCommand(t *testing.T) {
+	for _, shell := range []string{"bash", "sh"} {
+		t.Run(shell, func(t *testing.T) {
+			addr := startServer(t, &Config{AuthType: "foo:bar", Shell: shell})
+			client, err := dial(addr, "foo", ssh.Password("bar"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			for _, sig := range []ssh.Signal{ssh.SIGINT, ssh.SIGTERM} {
+				sess, err := client.NewSession()
+				if err != nil {
+					t.Fatal(err)
+				}
+				//the signal must reach the sleep, not only the shell
+				start := time.Now()
+				if err := sess.Start("sleep 5; true"); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(300 * time.Millisecond)
+				if err := sess.Signal(sig); err != nil {
+					t.Fatal(err)
+				}
+				err = sess.Wait()
+				if d := time.Since(start); d > 3*time.Second {
+					t.Errorf("%s: exited after %s", sig, d)
+				}
+				var exitErr *ssh.ExitError
+				if !errors.As(err, &exitErr) {
+					t.Errorf("%s: expected exit error, got %v", sig, err)
+				}
+				sess.Close()
+			}
+		})
+	}
+}
+
+func TestBackgroundProcessOutput(t *testing.T) {
+	addr := startServer(t, &Config{AuthType: "foo:bar"})
+	client, err := dial(addr, "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	//the background sleep holds the output pipes open
+	start := time.Now()
+	out, err := run(t, client, "sleep 5 & echo started")
+	if err != nil || out != "started\n" {
+		t.Fatalf("got %q (%v)", out, err)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("exited after %s", d)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package sshd
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// newProcessGroup starts the command in its own process group, so
+// signals reach all of its processes (e.g. the "sleep" of "sleep 3;
+// true"), and not only the shell running it
+func newProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalGroup sends sig to the process group led by p. Commands are
+// started as group leaders, either by newProcessGroup, or for shells,
+// as the leader of the session of their pty.
+func signalGroup(p *os.Process, sig syscall.Signal) error {
+	return syscall.Kill(-p.Pid, sig)
+}
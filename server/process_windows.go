@@ -0,0 +1,15 @@
+package sshd
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// newProcessGroup does nothing, since windows has no process groups
+func newProcessGroup(cmd *exec.Cmd) {}
+
+// signalGroup sends sig to p alone
+func signalGroup(p *os.Process, sig syscall.Signal) error {
+	return p.Signal(sig)
+}
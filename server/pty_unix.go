@@ -0,0 +1,44 @@
+//go:build !windows
+
+package sshd
+
+import (
+	"os"
+
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+// pollablePty returns the pty master in non-blocking mode, where
+// closing it interrupts pending reads, and so hangs up the shell.
+// Files are put in blocking mode by os.File.Fd (as used by the pty
+// package), after which a close waits for reads to return first.
+func pollablePty(p pty.Pty) pty.Pty {
+	f, ok := p.(*os.File)
+	if !ok {
+		return p
+	}
+	fd, err := unix.FcntlInt(f.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return p
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return p
+	}
+	f.Close()
+	return ptyFile{os.NewFile(uintptr(fd), f.Name())}
+}
+
+// ptyFile is a pty master, whose Fd leaves it non-blocking
+type ptyFile struct {
+	*os.File
+}
+
+func (f ptyFile) Fd() uintptr {
+	fd := ^uintptr(0)
+	if rc, err := f.SyscallConn(); err == nil {
+		rc.Control(func(p uintptr) { fd = p })
+	}
+	return fd
+}
@@ -2,10 +2,20 @@ package sshd
 
 import (
 	"encoding/binary"
+	"math"
 
 	"github.com/creack/pty"
+	"golang.org/x/crypto/ssh"
 )
 
+// ptyRequest is the payload of a "pty-req" request
+type ptyRequest struct {
+	Term          string
+	Columns, Rows uint32
+	Width, Height uint32
+	Modes         string
+}
+
 // parseDims extracts terminal dimensions (width x height) from the provided buffer.
 func parseDims(b []byte) (uint32, uint32) {
 	w := binary.BigEndian.Uint32(b)
@@ -13,10 +23,34 @@ func parseDims(b []byte) (uint32, uint32) {
 	return w, h
 }
 
-// SetWinsize sets the size of the given pty.
+// parseModes decodes the encoded terminal modes of a pty-req,
+// a list of opcodes and their uint32 values, ended by TTY_OP_END
+func parseModes(b []byte) ssh.TerminalModes {
+	modes := ssh.TerminalModes{}
+	for len(b) >= 5 {
+		op := b[0]
+		if op == 0 || op >= 160 {
+			//TTY_OP_END, or an opcode with an unknown argument
+			break
+		}
+		modes[op] = binary.BigEndian.Uint32(b[1:])
+		b = b[5:]
+	}
+	return modes
+}
+
+// SetWinsize sets the size of the given pty. Sizes
+// larger than a pty supports are clamped.
 func SetWinsize(t pty.FdHolder, w, h uint32) {
-	ws := &pty.Winsize{Rows: uint16(h), Cols: uint16(w)}
+	ws := &pty.Winsize{Rows: clampDim(h), Cols: clampDim(w)}
 	pty.Setsize(t, ws)
 }
 
+func clampDim(d uint32) uint16 {
+	if d > math.MaxUint16 {
+		return math.MaxUint16
+	}
+	return uint16(d)
+}
+
 // Borrowed from https://github.com/creack/termios/blob/master/win/win.go
@@ -0,0 +1,8 @@
+package sshd
+
+import "github.com/creack/pty"
+
+// pollablePty is only needed for unix ptys
+func pollablePty(p pty.Pty) pty.Pty {
+	return p
+}
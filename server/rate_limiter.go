@@ -0,0 +1,62 @@
+package sshd
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket, limiting the bytes written
+// per second. Up to a second of output may be written in a
+// single burst.
+type rateLimiter struct {
+	rate   float64
+	mut    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes may be written
+func (rl *rateLimiter) wait(n int) {
+	rl.mut.Lock()
+	defer rl.mut.Unlock()
+	//refill, up to a second's worth
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.rate {
+		rl.tokens = rl.rate
+	}
+	rl.last = now
+	//writes may overdraw, and then wait for the debt to be repaid
+	rl.tokens -= float64(n)
+	if rl.tokens < 0 {
+		time.Sleep(time.Duration(-rl.tokens / rl.rate * float64(time.Second)))
+		rl.tokens = 0
+		rl.last = time.Now()
+	}
+}
+
+// writer limits writes to w. Writes beyond the rate block, rather
+// than being dropped, which in turn blocks the reader (e.g. a
+// shell's pty) until output may flow again.
+func (rl *rateLimiter) writer(w io.Writer) io.Writer {
+	return rateWriter{rl, w}
+}
+
+type rateWriter struct {
+	rl *rateLimiter
+	w  io.Writer
+}
+
+func (rw rateWriter) Write(p []byte) (int, error) {
+	rw.rl.wait(len(p))
+	return rw.w.Write(p)
+}
@@ -0,0 +1,24 @@
+package sshd
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	w := newRateLimiter(1000).writer(io.Discard)
+	start := time.Now()
+	//a second of output is a burst...
+	w.Write(make([]byte, 1000))
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("burst took %s", d)
+	}
+	//...after which output is throttled
+	for i := 0; i < 5; i++ {
+		w.Write(make([]byte, 100))
+	}
+	if d := time.Since(start); d < 400*time.Millisecond || d > time.Second {
+		t.Errorf("expected about 500ms, took %s", d)
+	}
+}
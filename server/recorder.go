@@ -0,0 +1,170 @@
+package sshd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// recorder writes session output to an asciinema v2 .cast file.
+// Events are queued and written in the background, and are
+// dropped (and counted) if the disk falls behind, so recording
+// never blocks the session. All methods are no-ops on a nil recorder.
+type recorder struct {
+	file   *os.File
+	start  time.Time
+	mut    sync.Mutex
+	closed bool
+	//events dropped while the queue was full
+	dropped int
+	//the start of a rune split across writes
+	partial []byte
+	events  chan []interface{}
+	done    chan struct{}
+}
+
+// castHeader is the first line of an asciinema v2 file
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+func newRecorder(dir string, sess *session, shell, term string) (*recorder, error) {
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s.cast", now.UTC().Format("20060102T150405Z"), sess.id)
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	header := castHeader{
+		Version:   2,
+		Width:     sess.cols,
+		Height:    sess.rows,
+		Timestamp: now.Unix(),
+		Env: map[string]string{
+			"SHELL": shell,
+			"TERM":  term,
+		},
+	}
+	//players decode the output using the locale of the session
+	if lang := getEnv(sess.env, "LANG"); lang != "" {
+		header.Env["LANG"] = lang
+	}
+	b, _ := json.Marshal(header)
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := &recorder{
+		file:   f,
+		start:  now,
+		events: make(chan []interface{}, 256),
+		done:   make(chan struct{}),
+	}
+	go r.flush()
+	return r, nil
+}
+
+func (r *recorder) flush() {
+	w := bufio.NewWriter(r.file)
+	enc := json.NewEncoder(w)
+	for e := range r.events {
+		enc.Encode(e)
+		//write out whenever the queue is drained
+		if len(r.events) == 0 {
+			w.Flush()
+		}
+	}
+	w.Flush()
+	r.file.Close()
+	close(r.done)
+}
+
+func (r *recorder) event(code, data string) {
+	if r == nil {
+		return
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.send(code, data)
+}
+
+// send queues an event, r.mut must be held
+func (r *recorder) send(code, data string) {
+	if r.closed {
+		return
+	}
+	t := time.Since(r.start).Seconds()
+	select {
+	case r.events <- []interface{}{t, code, data}:
+	default:
+		r.dropped++
+	}
+}
+
+// Write records output. Write never fails. A rune split across
+// writes is held back until it is complete, since encoding either
+// half alone would replace it.
+func (r *recorder) Write(p []byte) (int, error) {
+	if r == nil {
+		return len(p), nil
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	b := append(r.partial, p...)
+	n := len(b) - incompleteRune(b)
+	r.partial = append([]byte(nil), b[n:]...)
+	if n > 0 {
+		r.send("o", string(b[:n]))
+	}
+	return len(p), nil
+}
+
+// incompleteRune returns the length of the
+// unfinished rune at the end of b, if any
+func incompleteRune(b []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		if utf8.RuneStart(b[len(b)-i]) {
+			if !utf8.FullRune(b[len(b)-i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return 0
+}
+
+func (r *recorder) resize(w, h uint32) {
+	r.event("r", fmt.Sprintf("%dx%d", w, h))
+}
+
+// close writes out queued events and closes the file
+func (r *recorder) close() {
+	if r == nil {
+		return
+	}
+	r.mut.Lock()
+	//output ended mid-rune, record what there is
+	if len(r.partial) > 0 {
+		r.send("o", string(r.partial))
+		r.partial = nil
+	}
+	if !r.closed {
+		r.closed = true
+		close(r.events)
+		if r.dropped > 0 {
+			log.Printf("Dropped %d events of recording %s, the disk is too slow", r.dropped, r.file.Name())
+		}
+	}
+	r.mut.Unlock()
+	<-r.done
+}
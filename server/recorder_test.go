@@ -0,0 +1,76 @@
+package sshd
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	dir := t.TempDir()
+	sess := &session{id: "abc", cols: 80, rows: 24, env: []string{"LANG=en_US.UTF-8"}}
+	r, err := newRecorder(dir, sess, "/bin/bash", "xterm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("hello\r\n"))
+	r.resize(100, 30)
+	//"é" split across writes
+	r.Write([]byte("bye \xc3"))
+	r.Write([]byte("\xa9"))
+	r.close()
+	r.Write([]byte("ignored"))
+	casts, _ := filepath.Glob(filepath.Join(dir, "*-abc.cast"))
+	if len(casts) != 1 {
+		t.Fatalf("expected 1 recording, got %v", casts)
+	}
+	f, err := os.Open(casts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	var header castHeader
+	if !sc.Scan() || json.Unmarshal(sc.Bytes(), &header) != nil {
+		t.Fatal("missing header")
+	}
+	if header.Version != 2 || header.Width != 80 || header.Height != 24 ||
+		header.Env["SHELL"] != "/bin/bash" || header.Env["TERM"] != "xterm" || header.Env["LANG"] != "en_US.UTF-8" {
+		t.Errorf("unexpected header %+v", header)
+	}
+	want := [][2]string{{"o", "hello\r\n"}, {"r", "100x30"}, {"o", "bye "}, {"o", "é"}}
+	last, n := 0.0, 0
+	for ; sc.Scan(); n++ {
+		var e []interface{}
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil || len(e) != 3 {
+			t.Fatalf("event %d: invalid %s", n, sc.Bytes())
+		}
+		ts, _ := e[0].(float64)
+		if n >= len(want) || ts < last || e[1] != want[n][0] || e[2] != want[n][1] {
+			t.Fatalf("event %d: unexpected %s", n, sc.Bytes())
+		}
+		last = ts
+	}
+	if n != len(want) {
+		t.Errorf("expected %d events, got %d", len(want), n)
+	}
+}
+
+func TestRecorderDropped(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "test.cast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//a queue of one event, which is never written out
+	r := &recorder{file: f, events: make(chan []interface{}, 1), done: make(chan struct{})}
+	for i := 0; i < 3; i++ {
+		r.Write([]byte("x"))
+	}
+	if r.dropped != 2 {
+		t.Errorf("expected 2 dropped events, got %d", r.dropped)
+	}
+	close(r.done)
+	r.close()
+}
@@ -0,0 +1,53 @@
+package sshd
+
+// scrollback keeps the most recent output of a session in a
+// fixed size ring, so output is never copied to make room.
+// A nil scrollback keeps nothing.
+type scrollback struct {
+	size int
+	//allocated on the first write, sessions may have no output
+	buf []byte
+	//the next write position, and whether the ring has wrapped
+	pos  int
+	full bool
+}
+
+func newScrollback(size int) *scrollback {
+	if size <= 0 {
+		return nil
+	}
+	return &scrollback{size: size}
+}
+
+func (sb *scrollback) write(p []byte) {
+	if sb == nil {
+		return
+	}
+	size := sb.size
+	if sb.buf == nil {
+		sb.buf = make([]byte, size)
+	}
+	if len(p) >= size {
+		//only the end of p fits
+		copy(sb.buf, p[len(p)-size:])
+		sb.pos, sb.full = 0, true
+		return
+	}
+	n := copy(sb.buf[sb.pos:], p)
+	copy(sb.buf, p[n:])
+	if sb.pos+len(p) >= size {
+		sb.full = true
+	}
+	sb.pos = (sb.pos + len(p)) % size
+}
+
+// bytes returns a copy of the output kept, oldest first
+func (sb *scrollback) bytes() []byte {
+	if sb == nil {
+		return nil
+	}
+	if !sb.full {
+		return append([]byte(nil), sb.buf[:sb.pos]...)
+	}
+	return append(append([]byte(nil), sb.buf[sb.pos:]...), sb.buf[:sb.pos]...)
+}
@@ -0,0 +1,32 @@
+package sshd
+
+import "testing"
+
+func TestScrollback(t *testing.T) {
+	for _, c := range []struct {
+		writes []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{"ab"}, "ab"},
+		{[]string{"ab", "cd"}, "abcd"},
+		{[]string{"ab", "cde"}, "bcde"},
+		{[]string{"abc", "de", "fgh"}, "efgh"},
+		{[]string{"abcdefg"}, "defg"},
+		{[]string{"a", "bcdefg", "h"}, "efgh"},
+	} {
+		sb := newScrollback(4)
+		for _, w := range c.writes {
+			sb.write([]byte(w))
+		}
+		if got := string(sb.bytes()); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.writes, got, c.want)
+		}
+	}
+	//disabled
+	sb := newScrollback(-1)
+	sb.write([]byte("abc"))
+	if b := sb.bytes(); b != nil {
+		t.Errorf("expected nothing kept, got %q", b)
+	}
+}
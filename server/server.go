@@ -1,15 +1,21 @@
 package sshd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/creack/pty"
@@ -18,13 +24,44 @@ import (
 
 // Server is a simple SSH Daemon
 type Server struct {
-	cli    *Config
-	config *ssh.ServerConfig
+	cli         *Config
+	config      *ssh.ServerConfig
+	sessionsMut sync.Mutex
+	sessions    map[string]*session
+	counters    counters
+	limiter     *connLimiter
+	execAllow   []*regexp.Regexp
+	auditMut    sync.Mutex
+	keysMut     sync.Mutex
+	checkedKeys map[string]string
+	//background tasks (e.g. refreshing keys), run while serving
+	background  []func(ctx context.Context)
+	servingMut  sync.Mutex
+	serving     int
+	cancelTasks context.CancelFunc
 }
 
 // NewServer creates a new Server
 func NewServer(c *Config) (*Server, error) {
-	s := &Server{cli: c}
+	s := &Server{
+		cli:         c,
+		sessions:    map[string]*session{},
+		checkedKeys: map[string]string{},
+	}
+	if n := c.MaxConnsPerIP; n > 0 {
+		window := time.Duration(c.ConnRateWindow) * time.Second
+		if window <= 0 {
+			window = time.Minute
+		}
+		s.limiter = newConnLimiter(n, window)
+	}
+	for _, a := range c.ExecAllowlist {
+		re, err := execPattern(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exec allowlist entry %q (%s)", a, err)
+		}
+		s.execAllow = append(s.execAllow, re)
+	}
 	sc, err := s.computeSSHConfig()
 	if err != nil {
 		return nil, err
@@ -35,44 +72,195 @@ func NewServer(c *Config) (*Server, error) {
 
 // Start listening on port
 func (s *Server) Start() error {
-	h := s.cli.Host
-	p := s.cli.Port
-	var l net.Listener
-	var err error
+	return s.StartContext(context.Background())
+}
 
-	//listen
-	if p == "" {
-		p = "22"
-		l, err = net.Listen("tcp", h+":22")
+// StartContext listens on port, or on each of the Listen
+// addresses, and serves connections until the context is cancelled
+func (s *Server) StartContext(ctx context.Context) error {
+	listeners, err := s.listen()
+	if err != nil {
+		return err
+	}
+
+	//optionally serve metrics
+	if a := s.cli.MetricsAddr; a != "" {
+		ml, err := net.Listen("tcp", a)
 		if err != nil {
-			p = "2200"
-			l, err = net.Listen("tcp", h+":2200")
-			if err != nil {
-				return fmt.Errorf("failed to listen on 22 and 2200")
+			for _, l := range listeners {
+				l.Close()
 			}
+			return fmt.Errorf("failed to listen for metrics on %s", a)
 		}
-	} else {
-		l, err = net.Listen("tcp", h+":"+p)
+		defer ml.Close()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", s.MetricsHandler())
+		go http.Serve(ml, mux)
+		log.Printf("Serving metrics on http://%s/metrics", ml.Addr())
+	}
+	//optionally serve health checks
+	if a := s.cli.HealthCheckAddr; a != "" {
+		hl, err := net.Listen("tcp", a)
 		if err != nil {
-			return fmt.Errorf("failed to listen on " + p)
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("failed to listen for health checks on %s", a)
 		}
+		defer hl.Close()
+		go http.Serve(hl, s.HealthHandler())
+		log.Printf("Serving health checks on http://%s/", hl.Addr())
+	}
+	for _, l := range listeners {
+		log.Printf("Listening on %s...", l.Addr())
 	}
 
+	//serve each listener, until one fails or the context is cancelled
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- s.StartWithContext(ctx, l)
+		}(l)
+	}
+	for range listeners {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+			cancel()
+		}
+	}
+	return err
+}
+
+// listen opens the Listen addresses, or otherwise, Host and Port
+func (s *Server) listen() ([]net.Listener, error) {
+	if len(s.cli.Listen) == 0 {
+		l, err := s.listenHostPort()
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	listeners := []net.Listener{}
+	for _, a := range s.cli.Listen {
+		l, err := net.Listen("tcp", a)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on %s", a)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func (s *Server) listenHostPort() (net.Listener, error) {
+	//accept bracketed IPv6 hosts (e.g. "[::1]")
+	h := strings.TrimSuffix(strings.TrimPrefix(s.cli.Host, "["), "]")
+	p := s.cli.Port
+	if p == "" {
+		l, err := net.Listen("tcp", net.JoinHostPort(h, "22"))
+		if err != nil {
+			l, err = net.Listen("tcp", net.JoinHostPort(h, "2200"))
+			if err != nil {
+				return nil, fmt.Errorf("failed to listen on 22 and 2200")
+			}
+		}
+		return l, nil
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(h, p))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on " + p)
+	}
+	return l, nil
+}
+
+// StartWith serves connections from the given listener,
+// until the listener is closed
+func (s *Server) StartWith(l net.Listener) error {
+	return s.StartWithContext(context.Background(), l)
+}
+
+// StartWithContext serves connections from the given listener,
+// until the listener is closed or the context is cancelled.
+// Cancelling the context closes the listener and returns nil.
+// Established connections are left to finish on their own.
+func (s *Server) StartWithContext(ctx context.Context, l net.Listener) error {
+	s.startServing()
+	defer s.stopServing()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-done:
+		}
+	}()
 	// Accept all connections
-	log.Printf("Listening on %s:%s...", h, p)
 	for {
 		tcpConn, err := l.Accept()
-		if err != nil {
+		if ctx.Err() != nil {
+			if err == nil {
+				tcpConn.Close()
+			}
+			return nil
+		} else if errors.Is(err, net.ErrClosed) {
+			return err
+		} else if err != nil {
 			log.Printf("Failed to accept incoming connection (%s)", err)
 			continue
 		}
+		if s.limiter != nil {
+			if ip := remoteIP(tcpConn.RemoteAddr()); !s.limiter.allow(ip, time.Now()) {
+				s.debugf("Too many connections from %s, dropped", ip)
+				tcpConn.Close()
+				continue
+			}
+		}
 		go s.handleConn(tcpConn)
 	}
 }
 
+// startServing starts the background tasks, if not already
+// started by another listener
+func (s *Server) startServing() {
+	s.servingMut.Lock()
+	defer s.servingMut.Unlock()
+	if s.serving == 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		for _, task := range s.background {
+			go task(ctx)
+		}
+		s.cancelTasks = cancel
+	}
+	s.serving++
+}
+
+// stopServing stops the background tasks, once the
+// last listener has stopped
+func (s *Server) stopServing() {
+	s.servingMut.Lock()
+	defer s.servingMut.Unlock()
+	if s.serving--; s.serving == 0 {
+		s.cancelTasks()
+	}
+}
+
 func (s *Server) handleConn(tcpConn net.Conn) {
+	if filter := s.cli.ConnectionFilter; filter != nil {
+		if err := filter(tcpConn); err != nil {
+			log.Printf("Connection from %s rejected (%s)", tcpConn.RemoteAddr(), err)
+			tcpConn.Close()
+			return
+		}
+	}
+	s.tuneConn(tcpConn)
 	// Before use, a handshake must be performed on the incoming net.Conn.
 	sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, s.config)
+	s.forgetKey(tcpConn.RemoteAddr())
 	if err != nil {
 		if err != io.EOF {
 			log.Printf("Failed to handshake (%s)", err)
@@ -80,20 +268,92 @@ func (s *Server) handleConn(tcpConn net.Conn) {
 		return
 	}
 	s.debugf("New SSH connection from %s (%s)", sshConn.RemoteAddr(), sshConn.ClientVersion())
-	// Discard all global out-of-band Requests
-	go ssh.DiscardRequests(reqs)
+	// Authorize the authenticated user, before serving anything
+	if authorize := s.cli.AuthorizeConn; authorize != nil {
+		if err := authorize(sshConn.User(), sshConn.Permissions, sshConn.RemoteAddr()); err != nil {
+			log.Printf("User '%s' from %s not authorized (%s)", sshConn.User(), sshConn.RemoteAddr(), err)
+			sshConn.Close()
+			return
+		}
+	}
+	s.counters.connections.Add(1)
+	s.counters.activeConnections.Add(1)
+	s.event("connected",
+		"user", sshConn.User(),
+		"remote_ip", remoteIP(sshConn.RemoteAddr()),
+		"client_version", string(sshConn.ClientVersion()))
+	closed := make(chan struct{})
+	if ka := s.cli.KeepAlive; ka > 0 {
+		go s.connKeepAlive(sshConn, time.Duration(ka)*time.Second, closed)
+	}
+	go func() {
+		start := time.Now()
+		err := sshConn.Wait()
+		close(closed)
+		s.counters.activeConnections.Add(-1)
+		if err == io.EOF {
+			err = nil
+		}
+		s.disconnectLog(sshConn.User(), sshConn.RemoteAddr(), start, err)
+	}()
+	// Handle global out-of-band Requests
+	go s.handleGlobalRequests(reqs)
 	// Accept all channels
-	go s.handleChannels(chans)
+	go s.handleChannels(sshConn, chans)
+}
+
+func (s *Server) handleGlobalRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "keepalive@openssh.com":
+			// Acknowledge client keep alives (ServerAliveInterval)
+			req.Reply(true, nil)
+		default:
+			s.debugf("unknown global request: %s (reply: %v)", req.Type, req.WantReply)
+			req.Reply(false, nil)
+		}
+	}
 }
 
-func (s *Server) handleChannels(chans <-chan ssh.NewChannel) {
+// tuneConn applies socket options to TCP connections,
+// other connection types (e.g. unix sockets) are left as-is
+func (s *Server) tuneConn(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tc.SetNoDelay(!s.cli.TCPDelay); err != nil {
+		s.debugf("Failed to set TCP_NODELAY (%s)", err)
+	}
+	if n := s.cli.TCPBufferSize; n > 0 {
+		if err := tc.SetReadBuffer(n); err != nil {
+			s.debugf("Failed to set read buffer (%s)", err)
+		}
+		if err := tc.SetWriteBuffer(n); err != nil {
+			s.debugf("Failed to set write buffer (%s)", err)
+		}
+	}
+}
+
+func (s *Server) handleChannels(sshConn *ssh.ServerConn, chans <-chan ssh.NewChannel) {
+	// open channels of this connection
+	var open atomic.Int64
 	// Service the incoming Channel channel in go routine
 	for newChannel := range chans {
-		go s.handleChannel(newChannel)
+		if max := s.cli.MaxChannelsPerConn; max > 0 && open.Load() >= int64(max) {
+			s.debugf("Channel rejected, %d channels open", max)
+			newChannel.Reject(ssh.ResourceShortage, "too many channels")
+			continue
+		}
+		open.Add(1)
+		go func(newChannel ssh.NewChannel) {
+			s.handleChannel(sshConn, newChannel)
+			open.Add(-1)
+		}(newChannel)
 	}
 }
 
-func (s *Server) handleChannel(newChannel ssh.NewChannel) {
+func (s *Server) handleChannel(sshConn *ssh.ServerConn, newChannel ssh.NewChannel) {
 	if t := newChannel.ChannelType(); t != "session" {
 		newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
 		return
@@ -110,10 +370,10 @@ func (s *Server) handleChannel(newChannel ssh.NewChannel) {
 		return
 	}
 	s.debugf("Channel accepted")
-	go s.handleRequests(connection, requests)
+	s.handleRequests(sshConn, connection, requests)
 }
 
-func (s *Server) handleRequests(connection ssh.Channel, requests <-chan *ssh.Request) {
+func (s *Server) handleRequests(sshConn *ssh.ServerConn, connection ssh.Channel, requests <-chan *ssh.Request) {
 	// start keep alive loop
 	if ka := s.cli.KeepAlive; ka > 0 {
 		ticking := make(chan bool, 1)
@@ -122,48 +382,198 @@ func (s *Server) handleRequests(connection ssh.Channel, requests <-chan *ssh.Req
 		defer close(ticking)
 	}
 	// prepare to handle client requests
-	env := os.Environ()
-	resizes := make(chan []byte, 10)
-	defer close(resizes)
+	sess := newSession(sshConn, connection, os.Environ())
+	size := s.cli.ScrollbackBytes
+	if size == 0 {
+		size = defaultScrollback
+	}
+	sess.scrollback = newScrollback(size)
+	defer close(sess.resizes)
+	s.addSession(sess)
+	defer s.removeSession(sess)
+	// close idle sessions, which would otherwise be held open forever
+	if st := s.cli.SessionStartTimeout; st > 0 {
+		timer := time.AfterFunc(time.Duration(st)*time.Second, func() {
+			s.debugf("Session %s not started, closing", sess.id)
+			connection.Close()
+		})
+		defer timer.Stop()
+		sess.startTimer = timer
+	}
 	// Sessions have out-of-band requests such as "shell", "pty-req" and "env"
 	for req := range requests {
 		switch req.Type {
 		case "pty-req":
-			termLen := req.Payload[3]
-			resizes <- req.Payload[termLen+4:]
+			p := ptyRequest{}
+			if err := ssh.Unmarshal(req.Payload, &p); err != nil {
+				s.debugf("invalid pty-req: %s", err)
+				req.Reply(false, nil)
+				continue
+			}
+			sess.setPty(p.Columns, p.Rows)
+			sess.ptyTerm = p.Term
+			s.event("pty.requested", "session", sess.id, "user", sess.user(), "term", p.Term, "cols", p.Columns, "rows", p.Rows)
+			sess.modes = parseModes([]byte(p.Modes))
+			sess.resize(req.Payload[4+len(p.Term):])
 			// Responding true (OK) here will let the client
 			// know we have a pty ready
-			s.debugf("pty ready")
+			s.debugf("pty ready (%s)", p.Term)
 			req.Reply(true, nil)
 		case "window-change":
-			resizes <- req.Payload
+			if len(req.Payload) < 8 {
+				s.debugf("invalid window-change: %x", req.Payload)
+				req.Reply(false, nil)
+				continue
+			}
+			cols, rows := parseDims(req.Payload)
+			sess.resize(req.Payload)
+			sess.setSize(cols, rows)
+			s.event("pty.resized", "session", sess.id, "user", sess.user(), "cols", cols, "rows", rows)
+			req.Reply(true, nil)
 		case "env":
 			e := struct{ Name, Value string }{}
-			ssh.Unmarshal(req.Payload, &e)
+			if err := ssh.Unmarshal(req.Payload, &e); err != nil || e.Name == "" || strings.Contains(e.Name, "=") {
+				s.debugf("invalid env: %x", req.Payload)
+				req.Reply(false, nil)
+				continue
+			}
 			kv := e.Name + "=" + e.Value
 			s.debugf("env: %s", kv)
 			if !s.cli.IgnoreEnv {
-				env = appendEnv(env, kv)
+				sess.env = appendEnv(sess.env, kv)
+				if e.Name == "TERM" {
+					sess.envTerm = e.Value
+				}
 			}
+			req.Reply(!s.cli.IgnoreEnv, nil)
 		case "shell":
 			// Responding true (OK) here will let the client
 			// know we have attached the shell (pty) to the connection
 			if len(req.Payload) > 0 {
 				s.debugf("shell command ignored '%s'", req.Payload)
 			}
-			err := s.attachShell(connection, env, resizes)
+			if sess.started {
+				s.debugf("shell already started")
+				req.Reply(false, nil)
+				continue
+			}
+			sess.start()
+			s.event("session.started", "session", sess.id, "user", sess.user(), "type", "shell")
+			var err error
+			if s.forcedCommand(sess) != "" {
+				err = s.runForcedCommand(sess, "")
+			} else if len(s.execAllow) > 0 {
+				//restricted to the allowed commands
+				req.Reply(true, nil)
+				s.auditRejected(sess, "")
+				s.rejectCommand(sess, "shell not allowed")
+				continue
+			} else if sess.pty {
+				err = s.attachShell(sess, "")
+			} else {
+				err = s.attachPipedShell(sess)
+			}
 			if err != nil {
 				s.debugf("exec shell: %s", err)
 			}
 			req.Reply(err == nil, nil)
 		case "exec":
-			s.debugf("exec ignored '%s'", req.Payload)
+			e := struct{ Command string }{}
+			if err := ssh.Unmarshal(req.Payload, &e); err != nil {
+				s.debugf("invalid exec: %x", req.Payload)
+				req.Reply(false, nil)
+				continue
+			}
+			if sess.started {
+				s.debugf("session already started")
+				req.Reply(false, nil)
+				continue
+			}
+			sess.start()
+			s.event("session.started", "session", sess.id, "user", sess.user(), "type", "exec", "command", e.Command)
+			var err error
+			if s.forcedCommand(sess) != "" {
+				err = s.runForcedCommand(sess, e.Command)
+			} else if !s.execAllowed(e.Command) {
+				req.Reply(true, nil)
+				s.auditRejected(sess, e.Command)
+				s.rejectCommand(sess, "command not allowed: "+e.Command)
+				continue
+			} else {
+				err = s.runCommand(sess, e.Command)
+			}
+			if err != nil {
+				s.debugf("exec: %s", err)
+			}
+			req.Reply(err == nil, nil)
+		case "auth-agent-req@openssh.com":
+			if !s.cli.AgentForwarding || sess.agent != nil || keyForbids(sess, noAgentForwardingExtension) {
+				req.Reply(false, nil)
+				continue
+			}
+			err := s.forwardAgent(sess)
+			if err != nil {
+				s.debugf("Failed to forward agent (%s)", err)
+			} else {
+				s.event("forward.requested", "session", sess.id, "user", sess.user(), "type", "agent")
+			}
+			req.Reply(err == nil, nil)
+		case "x11-req":
+			x := x11Request{}
+			if err := ssh.Unmarshal(req.Payload, &x); err != nil {
+				s.debugf("invalid x11-req: %x", req.Payload)
+				req.Reply(false, nil)
+				continue
+			}
+			if !s.cli.X11Forwarding || sess.x11 != nil || keyForbids(sess, noX11ForwardingExtension) {
+				req.Reply(false, nil)
+				continue
+			}
+			err := s.forwardX11(sess, x)
+			if err != nil {
+				s.debugf("Failed to forward x11 (%s)", err)
+			} else {
+				s.event("forward.requested", "session", sess.id, "user", sess.user(), "type", "x11")
+			}
+			req.Reply(err == nil, nil)
+		case "subsystem":
+			// No subsystems (e.g. sftp) are supported, so tell
+			// the user why, rather than just failing the request
+			sub := struct{ Name string }{}
+			if err := ssh.Unmarshal(req.Payload, &sub); err != nil {
+				s.debugf("invalid subsystem: %x", req.Payload)
+				req.Reply(false, nil)
+				continue
+			}
+			s.debugf("subsystem %s refused", sub.Name)
+			fmt.Fprintf(connection.Stderr(), "subsystem %s is not supported by this server\n", sub.Name)
+			req.Reply(false, nil)
+		case "signal":
+			sig := struct{ Signal string }{}
+			if err := ssh.Unmarshal(req.Payload, &sig); err != nil {
+				s.debugf("invalid signal: %x", req.Payload)
+				req.Reply(false, nil)
+				continue
+			}
+			if sess.proc == nil {
+				s.debugf("signal %s before session started", sig.Signal)
+				req.Reply(false, nil)
+				continue
+			}
+			err := sess.proc.signal(sig.Signal)
+			if err != nil {
+				s.debugf("signal %s: %s", sig.Signal, err)
+			}
+			req.Reply(err == nil, nil)
 		default:
 			s.debugf("unkown request: %s (reply: %v, data: %x)", req.Type, req.WantReply, req.Payload)
+			req.Reply(false, nil)
 		}
 	}
 }
 
+const defaultKeepAliveMaxMissed = 3
+
 func (s *Server) keepAlive(connection ssh.Channel, interval time.Duration, ticking <-chan bool) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
@@ -181,41 +591,201 @@ func (s *Server) keepAlive(connection ssh.Channel, interval time.Duration, ticki
 	}
 }
 
-func (s *Server) attachShell(connection ssh.Channel, env []string, resizes <-chan []byte) error {
-	shell := exec.Command(s.cli.Shell)
-	shell.Env = env
-	s.debugf("Session env: %v", env)
-
-	close := func() {
-		connection.Close()
-		if shell.Process != nil {
-			if ps, err := shell.Process.Wait(); err != nil && ps != nil {
-				log.Printf("Failed to exit shell (%s)", err)
+// connKeepAlive sends global keep alives on the connection, which,
+// unlike the session pings, are also sent to connections without
+// sessions. The connection is closed once too many go unanswered.
+func (s *Server) connKeepAlive(sshConn *ssh.ServerConn, interval time.Duration, closed <-chan struct{}) {
+	max := s.cli.KeepAliveMaxMissed
+	if max <= 0 {
+		max = defaultKeepAliveMaxMissed
+	}
+	var missed atomic.Int64
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if n := missed.Add(1); n > int64(max) {
+				log.Printf("Closing connection from %s, %d keep alives unanswered", sshConn.RemoteAddr(), max)
+				sshConn.Close()
+				return
 			}
+			go func() {
+				// any reply, even a failure, shows the client is alive
+				if _, _, err := sshConn.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+					missed.Store(0)
+				}
+			}()
+			s.debugf("sent connection keep alive")
+		case <-closed:
+			return
 		}
-		s.debugf("Session closed")
+	}
+}
+
+// userShell returns the shell and working directory of the given user
+func (s *Server) userShell(user string) (shell, dir string) {
+	shell, dir = s.cli.Shell, s.cli.WorkDir
+	if uc, ok := s.cli.UserOverrides[user]; ok {
+		if uc.Shell != "" {
+			shell = uc.Shell
+		}
+		if uc.WorkDir != "" {
+			dir = uc.WorkDir
+		}
+	}
+	return shell, dir
+}
+
+// sessionEnv returns the environment for the processes of the
+// session, optionally with its resolved terminal type
+func (s *Server) sessionEnv(sess *session, term bool) []string {
+	if term {
+		sess.env = appendEnv(sess.env, "TERM="+sess.term(s.cli.Term))
+	}
+	//forced env overrides the client
+	for _, kv := range s.cli.UserEnv[sess.user()] {
+		sess.env = appendEnv(sess.env, kv)
+	}
+	for _, kv := range s.cli.UserOverrides[sess.user()].Env {
+		sess.env = appendEnv(sess.env, kv)
+	}
+	s.debugf("Session env: %v", sess.env)
+	if charset := localeCharset(sess.env); charset != "" {
+		s.debugf("Session charset: %s", charset)
+		sess.mut.Lock()
+		sess.charset = charset
+		sess.mut.Unlock()
+	}
+	return sess.env
+}
+
+// attachShell starts the user's shell in a pty, or if
+// given, a command run by the user's shell
+func (s *Server) attachShell(sess *session, command string) error {
+	connection := sess.channel
+	path, dir := s.userShell(sess.user())
+	shell := exec.Command(path)
+	if command != "" {
+		shell = shellCommand(path, command)
+	}
+	shell.Dir = dir
+	shell.Env = s.sessionEnv(sess, true)
+
+	//output is always written to the session and its watchers
+	var output io.Writer = io.MultiWriter(connection, sess, byteCounter{&s.counters.bytesSent})
+	var rec *recorder
+	if dir := s.cli.SessionRecordDir; dir != "" {
+		r, err := newRecorder(dir, sess, path, sess.term(s.cli.Term))
+		if err != nil {
+			connection.Close()
+			return fmt.Errorf("could not start recording (%s)", err)
+		}
+		s.debugf("Recording session to %s", r.file.Name())
+		output = io.MultiWriter(output, r)
+		rec = r
+	}
+
+	if err := s.limitCommand(shell); err != nil {
+		rec.close()
+		connection.Close()
+		return err
 	}
 	//start a shell for this channel's connection
 	shellf, err := pty.Start(shell)
 	if err != nil {
-		close()
+		rec.close()
+		connection.Close()
 		return fmt.Errorf("could not start pty (%s)", err)
 	}
+	shellf = pollablePty(shellf)
+	//apply the client's terminal modes before any input is copied
+	if err := setModes(shellf, sess.modes); err != nil {
+		s.debugf("Failed to set terminal modes (%s)", err)
+	}
+	//the shell is only ever waited on by the reaper
+	proc := reap(shell)
+	sess.setProc(proc)
+	//input is written to the shell
+	var input io.Writer = io.MultiWriter(shellf, byteCounter{&s.counters.bytesReceived})
+	//the pty is not resized once closed, when its fd may be reused
+	var ptyMut sync.Mutex
+	closePty := func() {
+		ptyMut.Lock()
+		shellf.Close()
+		ptyMut.Unlock()
+	}
+	//hang up shells without input or output for too long
+	var idle *time.Timer
+	if it := s.cli.IdleTimeout; it > 0 {
+		d := time.Duration(it) * time.Second
+		idle = time.AfterFunc(d, func() {
+			s.debugf("Session %s idle, closing", sess.id)
+			connection.Write([]byte("\r\nTimed out waiting for input: auto-logout\r\n"))
+			closePty()
+			//the session is closed once the hung up shell exits, and
+			//closed directly should the shell ignore the hangup
+			select {
+			case <-proc.done:
+			case <-time.After(drainTimeout):
+				connection.Close()
+			}
+		})
+		output = io.MultiWriter(output, activity{idle, d})
+		input = io.MultiWriter(input, activity{idle, d})
+	}
+	//pause shells which flood their session with output
+	if r := s.cli.MaxOutputBytesPerSec; r > 0 {
+		output = newRateLimiter(r).writer(output)
+	}
+	close := func() {
+		// Closing the pty hangs up the shell, ensuring it exits
+		// and is reaped even when the client disconnects first.
+		closePty()
+		rec.close()
+		if idle != nil {
+			idle.Stop()
+		}
+		// Report how the shell ended, so clients are not left
+		// guessing when the session was closed by the server.
+		req, payload := proc.exitRequest()
+		if _, err := connection.SendRequest(req, false, payload); err == nil {
+			s.debugf("Sent %s", req)
+		}
+		connection.Close()
+		s.debugf("Session closed")
+	}
 	//dequeue resizes
 	go func() {
-		for payload := range resizes {
+		for payload := range sess.resizes {
 			w, h := parseDims(payload)
+			ptyMut.Lock()
 			SetWinsize(shellf, w, h)
+			ptyMut.Unlock()
+			rec.resize(w, h)
 		}
 	}()
+	//show the motd ahead of any shell output, but not
+	//ahead of the output of commands (e.g. "ssh -t host top")
+	if s.cli.MOTD != "" && sess.pty && command == "" {
+		motd := strings.ReplaceAll(strings.TrimRight(s.cli.MOTD, "\n"), "\n", "\r\n")
+		output.Write([]byte(motd + "\r\n"))
+	}
 	//pipe session to shell and visa-versa
 	var once sync.Once
+	drained := make(chan struct{}, 1)
 	go func() {
-		io.Copy(connection, shellf)
+		//tee output to session watchers and the recording
+		s.copyBuffer(output, shellf)
+		drained <- struct{}{}
 		once.Do(close)
 	}()
 	go func() {
-		io.Copy(shellf, connection)
+		s.copyBuffer(input, connection)
+		//like sshd, the end of input leaves the shell running (e.g.
+		//"ssh -t host cmd < /dev/null"), it is only hung up once
+		//the channel is closed
+		<-sess.done
 		once.Do(close)
 	}()
 	//
@@ -223,30 +793,121 @@ func (s *Server) attachShell(connection ssh.Channel, env []string, resizes <-cha
 	go func() {
 		// Start proactively listening for process death, for those ptys that
 		// don't signal on EOF.
-		if shell.Process != nil {
-			if ps, err := shell.Process.Wait(); err != nil && ps != nil {
-				log.Printf("Failed to exit shell (%s)", err)
-			}
-			// It appears that closing the pty is an idempotent operation
-			// therefore making this call ensures that the other two coroutines
-			// will fall through and exit, and there is no downside.
-			shellf.Close()
+		if _, err := proc.wait(); err != nil {
+			log.Printf("Failed to exit shell (%s)", err)
+		}
+		// Give the pty a moment to signal EOF, so the last of
+		// the output is not lost
+		select {
+		case <-drained:
+		case <-time.After(drainTimeout):
 		}
+		// It appears that closing the pty is an idempotent operation
+		// therefore making this call ensures that the other two coroutines
+		// will fall through and exit, and there is no downside.
+		closePty()
 		s.debugf("Shell terminated and Session closed")
 	}()
 	return nil
 }
 
-func (s *Server) loadAuthTypeFile(last time.Time) (map[string]string, time.Time, error) {
-	info, err := os.Stat(s.cli.AuthType)
+// drainTimeout is how long output is read from a pty,
+// or from pipes, after the process has exited
+const drainTimeout = time.Second
+
+func (s *Server) addSession(sess *session) {
+	s.sessionsMut.Lock()
+	s.sessions[sess.id] = sess
+	s.sessionsMut.Unlock()
+	s.counters.sessions.Add(1)
+	s.counters.activeSessions.Add(1)
+	s.debugf("Session %s opened", sess.id)
+}
+
+func (s *Server) removeSession(sess *session) {
+	s.sessionsMut.Lock()
+	delete(s.sessions, sess.id)
+	s.sessionsMut.Unlock()
+	s.counters.activeSessions.Add(-1)
+	sess.close()
+	if sess.started {
+		s.event("session.ended", "session", sess.id, "user", sess.user())
+	}
+}
+
+// WatchSession returns a read-only stream of the output of the
+// given session, beginning with its scrollback (recent output),
+// and then live output until the session ends. Output is
+// dropped when the reader falls behind, so watching never slows
+// down the session itself.
+func (s *Server) WatchSession(id string) (io.ReadCloser, error) {
+	s.sessionsMut.Lock()
+	sess, ok := s.sessions[id]
+	s.sessionsMut.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("session not found: %s", id)
+	}
+	return sess.watch()
+}
+
+// SessionInfo describes an active session
+type SessionInfo struct {
+	ID         string
+	User       string
+	RemoteAddr string
+	Start      time.Time
+	// Pty is set when a terminal was requested,
+	// with its current size in Cols and Rows
+	Pty        bool
+	Cols, Rows uint32
+	// Charset is the character set of the session
+	// locale (e.g. "UTF-8"), if known
+	Charset string
+}
+
+// ActiveSessions lists the open sessions, oldest first
+func (s *Server) ActiveSessions() []SessionInfo {
+	s.sessionsMut.Lock()
+	list := make([]SessionInfo, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		list = append(list, sess.info())
+	}
+	s.sessionsMut.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Start.Before(list[j].Start)
+	})
+	return list
+}
+
+// KillSession kills the shell or command of the given
+// session, and closes its channel
+func (s *Server) KillSession(id string) error {
+	s.sessionsMut.Lock()
+	sess, ok := s.sessions[id]
+	s.sessionsMut.Unlock()
+	if !ok {
+		return fmt.Errorf("session not found: %s", id)
+	}
+	s.debugf("Session %s killed", id)
+	sess.kill()
+	return nil
+}
+
+var errNotUpdated = errors.New("not updated")
+
+func (s *Server) loadAuthTypeFile(path string, last time.Time) (map[string]AuthorizedKey, time.Time, error) {
+	info, err := os.Stat(path)
 	if err != nil {
 		return nil, last, fmt.Errorf("missing auth keys file")
 	}
 	t := info.ModTime()
 	if t.Before(last) || t == last {
-		return nil, last, fmt.Errorf("not updated")
+		return nil, last, errNotUpdated
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, last, fmt.Errorf("unreadable auth keys file")
 	}
-	b, _ := ioutil.ReadFile(s.cli.AuthType)
 	keys, err := parseKeys(b)
 	if err != nil {
 		return nil, last, err
@@ -260,6 +921,49 @@ func (s *Server) debugf(f string, args ...interface{}) {
 	}
 }
 
+// copyBuffer copies src to dst, using a buffer of the configured size
+func (s *Server) copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	size := s.cli.CopyBufferSize
+	if size <= 0 {
+		return io.Copy(dst, src)
+	}
+	//hide ReaderFrom and WriterTo, so that our buffer is used
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, make([]byte, size))
+}
+
+// copyWriter copies output into its Writer using copyBuffer,
+// including the output of commands, which os/exec copies
+// with io.Copy and so with ReadFrom
+type copyWriter struct {
+	s *Server
+	io.Writer
+}
+
+func (w copyWriter) ReadFrom(r io.Reader) (int64, error) {
+	return w.s.copyBuffer(w.Writer, r)
+}
+
+// activity is a Writer which only restarts a timer
+type activity struct {
+	timer *time.Timer
+	d     time.Duration
+}
+
+func (a activity) Write(p []byte) (int, error) {
+	a.timer.Reset(a.d)
+	return len(p), nil
+}
+
+func getEnv(env []string, key string) string {
+	k := key + "="
+	for _, e := range env {
+		if strings.HasPrefix(e, k) {
+			return strings.TrimPrefix(e, k)
+		}
+	}
+	return ""
+}
+
 func appendEnv(env []string, kv string) []string {
 	p := strings.SplitN(kv, "=", 2)
 	k := p[0] + "="
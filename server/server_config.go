@@ -1,19 +1,26 @@
 package sshd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"os/exec"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
 func (s *Server) computeSSHConfig() (*ssh.ServerConfig, error) {
-	sc := &ssh.ServerConfig{}
+	sc := &ssh.ServerConfig{
+		AuthLogCallback: s.authLogCallback,
+		MaxAuthTries:    s.cli.MaxAuthTries,
+	}
 	if s.cli.Shell == "" {
 		if runtime.GOOS == "windows" {
 			s.cli.Shell = "powershell"
@@ -27,9 +34,23 @@ func (s *Server) computeSSHConfig() (*ssh.ServerConfig, error) {
 	}
 	s.cli.Shell = p
 	s.debugf("Session shell %s", s.cli.Shell)
+	for user, uc := range s.cli.UserOverrides {
+		if uc.Shell == "" {
+			continue
+		}
+		p, err := exec.LookPath(uc.Shell)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find shell for user %s: %s", user, uc.Shell)
+		}
+		uc.Shell = p
+		s.cli.UserOverrides[user] = uc
+	}
 
 	var key []byte
-	if s.cli.KeyFile != "" {
+	if s.cli.KeyPEM != "" {
+		//user provided key, typically from a secret
+		key = []byte(s.cli.KeyPEM)
+	} else if s.cli.KeyFile != "" {
 		//user provided key (can generate with 'ssh-keygen -t rsa')
 		b, err := ioutil.ReadFile(s.cli.KeyFile)
 		if err != nil {
@@ -38,9 +59,15 @@ func (s *Server) computeSSHConfig() (*ssh.ServerConfig, error) {
 		key = b
 	} else {
 		//generate key now
-		b, err := generateKey(s.cli.KeySeed)
+		if s.cli.KeyType == "" && s.cli.KeySeed != "" {
+			//seeded keys of earlier versions were rsa, keep them
+			s.cli.KeyType = "rsa"
+		} else if s.cli.KeyType == "" {
+			s.cli.KeyType = "ed25519"
+		}
+		b, err := generateKey(s.cli.KeyType, s.cli.KeySeed)
 		if err != nil {
-			return nil, fmt.Errorf("failed to generate private key")
+			return nil, fmt.Errorf("failed to generate private key (%s)", err)
 		}
 		key = b
 	}
@@ -48,87 +75,436 @@ func (s *Server) computeSSHConfig() (*ssh.ServerConfig, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse private key")
 	}
-	if s.cli.KeyFile != "" {
+	if s.cli.KeyPEM != "" {
+		log.Printf("Key from PEM")
+	} else if s.cli.KeyFile != "" {
 		log.Printf("Key from file %s", s.cli.KeyFile)
 	} else if s.cli.KeySeed == "" {
-		log.Printf("Key from system rng")
+		log.Printf("Key (%s) from system rng", s.cli.KeyType)
 	} else {
-		log.Printf("Key from seed")
+		log.Printf("Key (%s) from seed", s.cli.KeyType)
 	}
 
 	sc.AddHostKey(pri)
-	log.Printf("RSA key fingerprint is %s", fingerprint(pri.PublicKey()))
+	log.Printf("%s key fingerprint is %s", keyTypeName(pri.PublicKey()), Fingerprint(pri.PublicKey()))
+
+	if s.cli.Banner != "" {
+		sc.BannerCallback = s.bannerCallback()
+	}
 
 	//setup auth
-	if s.cli.AuthType == "none" {
+	if first, second, ok := multiFactorAuth(s.cli.AuthType); ok {
+		if err := s.multiFactorCallbacks(first, second, sc); err != nil {
+			return nil, err
+		}
+	} else {
+		if s.cli.AuthType != "" {
+			if err := s.setupAuth(s.cli.AuthType, sc); err != nil {
+				return nil, err
+			}
+		} else if s.cli.PasswordAuth != nil {
+			if err := s.setupAuth("password", sc); err != nil {
+				return nil, err
+			}
+		} else if s.cli.KeyboardInteractive == nil {
+			return nil, fmt.Errorf("missing auth-type")
+		}
+		s.keyboardInteractive(sc)
+	}
+	s.recordKeys(sc)
+	return sc, nil
+}
+
+// setupAuth sets the auth callbacks of sc for the given auth type
+func (s *Server) setupAuth(auth string, sc *ssh.ServerConfig) error {
+	if auth == "none" {
 		sc.NoClientAuth = true // very dangerous
 		log.Printf("Authentication disabled")
-	} else if strings.HasPrefix(s.cli.AuthType, "github.com/") {
-		username := strings.TrimPrefix(s.cli.AuthType, "github.com/")
-		if err := s.githubCallback(username, sc); err != nil {
-			return nil, err
+	} else if auth == "keyboard-interactive" {
+		if s.cli.KeyboardInteractive == nil {
+			return fmt.Errorf("missing keyboard-interactive callback")
+		}
+	} else if strings.HasPrefix(auth, "github.com/") {
+		username := strings.TrimPrefix(auth, "github.com/")
+		log.Printf("Fetching ssh public keys for github user %s", username)
+		if err := s.urlCallback("github", githubKeysURL(username), sc); err != nil {
+			return err
 		}
-	} else if strings.Contains(s.cli.AuthType, ":") {
-		pair := strings.SplitN(s.cli.AuthType, ":", 2)
+	} else if strings.HasPrefix(auth, "https://") || strings.HasPrefix(auth, "http://") {
+		log.Printf("Fetching ssh public keys from %s", auth)
+		if err := s.urlCallback("url", auth, sc); err != nil {
+			return err
+		}
+	} else if auth == "password" || (isUserPass(auth) && s.cli.PasswordAuth != nil) {
+		if s.cli.PasswordAuth == nil {
+			return fmt.Errorf("missing password callback")
+		}
+		s.passwordCallbacks(sc, func(conn ssh.ConnMetadata, pass string) error {
+			ok, err := s.cli.PasswordAuth(conn.User(), pass, conn.RemoteAddr())
+			if err != nil {
+				log.Printf("Failed to check password of user '%s' (%s)", conn.User(), err)
+				return fmt.Errorf("denied")
+			}
+			if !ok {
+				s.debugf("Authentication failed for user '%s'", conn.User())
+				return fmt.Errorf("denied")
+			}
+			s.debugf("User '%s' authenticated with password", conn.User())
+			return nil
+		})
+		log.Printf("Authentication enabled (password callback)")
+	} else if isUserPass(auth) {
+		pair := strings.SplitN(auth, ":", 2)
 		u := pair[0]
 		p := pair[1]
-		sc.PasswordCallback = func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			if conn.User() == u && string(pass) == p {
+		s.passwordCallbacks(sc, func(conn ssh.ConnMetadata, pass string) error {
+			if conn.User() == u && pass == p {
 				s.debugf("User '%s' authenticated with password", u)
-				return nil, nil
+				return nil
 			}
 			s.debugf("Authentication failed '%s:%s'", conn.User(), pass)
-			return nil, fmt.Errorf("denied")
-		}
+			return fmt.Errorf("denied")
+		})
 		log.Printf("Authentication enabled (user '%s')", u)
-	} else if s.cli.AuthType != "" {
-		if err := s.fileCallback(sc); err != nil {
+	} else {
+		if err := s.fileCallback(auth, sc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isUserPass reports whether auth is a "user:pass" pair, rather
+// than a keys file whose path has a colon (e.g. "C:\keys")
+func isUserPass(auth string) bool {
+	if !strings.Contains(auth, ":") {
+		return false
+	}
+	_, err := os.Stat(auth)
+	return err != nil
+}
+
+// passwordCallbacks sets the password callback of sc, and also
+// prompts for the password via keyboard-interactive, which
+// some clients prefer over the password method
+func (s *Server) passwordCallbacks(sc *ssh.ServerConfig, check func(conn ssh.ConnMetadata, pass string) error) {
+	sc.PasswordCallback = func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+		return nil, check(conn, string(pass))
+	}
+	sc.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		answers, err := client(conn.User(), "", []string{"Password: "}, []bool{false})
+		if err != nil {
 			return nil, err
 		}
+		if len(answers) != 1 {
+			return nil, fmt.Errorf("denied")
+		}
+		return nil, check(conn, answers[0])
+	}
+}
+
+// keyboardInteractive sets the custom challenges of
+// Config.KeyboardInteractive, if any, replacing the password prompt
+func (s *Server) keyboardInteractive(sc *ssh.ServerConfig) {
+	ki := s.cli.KeyboardInteractive
+	if ki == nil {
+		return
+	}
+	sc.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		return ki(conn.User(), client)
+	}
+	log.Printf("Authentication enabled (keyboard-interactive)")
+}
+
+// multiFactorAuth splits an auth type of the form "<keys>+<user:pass>"
+// (e.g. "~/.ssh/authorized_keys+foo:bar"), where the keys are a file,
+// github user or URL, and both factors are required. The password may
+// also be checked by Config.PasswordAuth ("<keys>+password").
+func multiFactorAuth(auth string) (string, string, bool) {
+	first, second, ok := strings.Cut(auth, "+")
+	if !ok || first == "" || second == "" {
+		return "", "", false
+	}
+	if strings.Contains(first, ":") && !strings.HasPrefix(first, "https://") && !strings.HasPrefix(first, "http://") {
+		//a password containing "+"
+		return "", "", false
+	}
+	if _, err := os.Stat(auth); err == nil {
+		//a keys file containing "+"
+		return "", "", false
+	}
+	return first, second, true
+}
+
+// multiFactorCallbacks requires the first auth type to pass, and then
+// the second. Success of the first is only a partial success, which
+// offers the client the methods of the second.
+func (s *Server) multiFactorCallbacks(first, second string, sc *ssh.ServerConfig) error {
+	f1 := &ssh.ServerConfig{}
+	if err := s.setupAuth(first, f1); err != nil {
+		return err
+	}
+	f2 := &ssh.ServerConfig{}
+	if err := s.setupAuth(second, f2); err != nil {
+		return err
+	}
+	s.recordKeys(f2)
+	//custom challenges are the first factor when named first,
+	//and otherwise are only offered as the second factor
+	if first == "keyboard-interactive" {
+		s.keyboardInteractive(f1)
 	} else {
-		return nil, fmt.Errorf("missing auth-type")
+		s.keyboardInteractive(f2)
 	}
-	return sc, nil
+	partial := func(perms *ssh.Permissions, err error) (*ssh.Permissions, error) {
+		if err != nil {
+			return nil, err
+		}
+		return perms, &ssh.PartialSuccessError{Next: secondFactor(f2, perms)}
+	}
+	if cb := f1.PasswordCallback; cb != nil {
+		sc.PasswordCallback = func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			return partial(cb(conn, pass))
+		}
+	}
+	if cb := f1.PublicKeyCallback; cb != nil {
+		sc.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return partial(cb(conn, key))
+		}
+	}
+	if cb := f1.KeyboardInteractiveCallback; cb != nil {
+		sc.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			return partial(cb(conn, client))
+		}
+	}
+	log.Printf("Authentication requires both factors")
+	return nil
 }
 
-func (s *Server) githubCallback(username string, sc *ssh.ServerConfig) error {
-	log.Printf("Fetching ssh public keys for github user %s", username)
-	keys, err := githubKeys(username)
-	if err != nil {
+// secondFactor returns the auth callbacks of sc, which on success also
+// carry the permissions of the first factor. Only the permissions of
+// the final callback are kept, so otherwise, restrictions of the first
+// factor (e.g. a key's forced command) would be lost.
+func secondFactor(sc *ssh.ServerConfig, first *ssh.Permissions) ssh.ServerAuthCallbacks {
+	merge := func(perms *ssh.Permissions, err error) (*ssh.Permissions, error) {
+		if err != nil {
+			return nil, err
+		}
+		return mergePermissions(first, perms), nil
+	}
+	next := ssh.ServerAuthCallbacks{}
+	if cb := sc.PasswordCallback; cb != nil {
+		next.PasswordCallback = func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			return merge(cb(conn, pass))
+		}
+	}
+	if cb := sc.PublicKeyCallback; cb != nil {
+		next.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return merge(cb(conn, key))
+		}
+	}
+	if cb := sc.KeyboardInteractiveCallback; cb != nil {
+		next.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			return merge(cb(conn, client))
+		}
+	}
+	return next
+}
+
+// mergePermissions combines the permissions of two factors,
+// where those of the first take precedence
+func mergePermissions(first, second *ssh.Permissions) *ssh.Permissions {
+	if first == nil {
+		return second
+	}
+	if second == nil {
+		return first
+	}
+	merged := &ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions:      map[string]string{},
+	}
+	for _, p := range []*ssh.Permissions{second, first} {
+		for k, v := range p.CriticalOptions {
+			merged.CriticalOptions[k] = v
+		}
+		for k, v := range p.Extensions {
+			merged.Extensions[k] = v
+		}
+	}
+	return merged
+}
+
+func (s *Server) bannerCallback() func(ssh.ConnMetadata) string {
+	path := s.cli.Banner
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		//not a file, show as is
+		return func(ssh.ConnMetadata) string {
+			return path
+		}
+	}
+	log.Printf("Banner from file %s", path)
+	var mut sync.Mutex
+	var banner string
+	var last time.Time
+	return func(ssh.ConnMetadata) string {
+		mut.Lock()
+		defer mut.Unlock()
+		//reload when modified, keeping the last banner on failure
+		info, err := os.Stat(path)
+		if err != nil {
+			s.debugf("Failed to stat banner (%s)", err)
+			return banner
+		}
+		if t := info.ModTime(); !t.Equal(last) {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				s.debugf("Failed to read banner (%s)", err)
+				return banner
+			}
+			banner = string(b)
+			last = t
+			s.debugf("Updated banner")
+		}
+		return banner
+	}
+}
+
+func (s *Server) urlCallback(source, url string, sc *ssh.ServerConfig) error {
+	if strings.HasPrefix(url, "http://") {
+		log.Printf("Warning: keys fetched over plain http can be replaced in transit, use https")
+	}
+	//initial fetch, falling back to the cache
+	keys, b, err := fetchKeys(url)
+	if err == nil {
+		s.writeKeysCache(b)
+	} else if cache := s.cli.KeysCacheFile; cache != "" {
+		log.Printf("Using cached keys (%s)", err)
+		b, err := os.ReadFile(cache)
+		if err != nil {
+			return fmt.Errorf("failed to read keys cache: %w", err)
+		}
+		if keys, err = parseFetchedKeys(b); err != nil {
+			return fmt.Errorf("failed to parse keys cache: %w", err)
+		}
+	} else {
 		return err
 	}
+	//periodically refresh, keeping the last keys on failure
+	var mut sync.RWMutex
+	interval := time.Duration(s.cli.KeysRefresh) * time.Second
+	if interval <= 0 {
+		interval = defaultKeysRefresh
+	}
+	s.background = append(s.background, func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			ks, b, err := fetchKeys(url)
+			if err != nil {
+				s.debugf("Failed to refresh keys (%s)", err)
+				continue
+			}
+			s.writeKeysCache(b)
+			mut.Lock()
+			keys = ks
+			mut.Unlock()
+			s.debugf("Refreshed keys #%d", len(ks))
+		}
+	})
 	sc.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-		return nil, s.matchKeys(key, keys)
+		mut.RLock()
+		defer mut.RUnlock()
+		return s.matchKeys(conn, key, keys)
 	}
-	log.Printf("Authentication enabled (github keys #%d)", len(keys))
+	log.Printf("Authentication enabled (%s keys #%d)", source, len(keys))
 	return nil
 }
 
-func (s *Server) fileCallback(sc *ssh.ServerConfig) error {
+const defaultKeysRefresh = 5 * time.Minute
+
+func (s *Server) writeKeysCache(b []byte) {
+	if cache := s.cli.KeysCacheFile; cache != "" {
+		if err := os.WriteFile(cache, b, 0600); err != nil {
+			log.Printf("Failed to write keys cache (%s)", err)
+		}
+	}
+}
+
+func (s *Server) fileCallback(path string, sc *ssh.ServerConfig) error {
+	failClosed := false
+	switch s.cli.AuthReloadPolicy {
+	case "", "fail-open":
+	case "fail-closed":
+		failClosed = true
+	default:
+		return fmt.Errorf("invalid auth reload policy: %s", s.cli.AuthReloadPolicy)
+	}
 	//initial key parse
-	keys, last, err := s.loadAuthTypeFile(time.Time{})
+	keys, last, err := s.loadAuthTypeFile(path, time.Time{})
 	if err != nil {
 		return err
 	}
 	//setup checker
+	var mut sync.Mutex
 	sc.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		mut.Lock()
+		defer mut.Unlock()
 		//update keys
-		if ks, t, err := s.loadAuthTypeFile(last); err == nil {
+		ks, t, err := s.loadAuthTypeFile(path, last)
+		if err == nil {
 			keys = ks
 			last = t
 			s.debugf("Updated authorized keys")
+		} else if err != errNotUpdated {
+			if failClosed {
+				//force a full reload once the file is fixed
+				keys = nil
+				last = time.Time{}
+			}
+			s.debugf("Failed to reload authorized keys (%s)", err)
 		}
-		return nil, s.matchKeys(key, keys)
+		return s.matchKeys(conn, key, keys)
 	}
 	log.Printf("Authentication enabled (public keys #%d)", len(keys))
 	return nil
 }
 
-func (s *Server) matchKeys(key ssh.PublicKey, keys map[string]string) error {
-	if cmt, exists := keys[string(key.Marshal())]; exists {
-		s.debugf("User '%s' authenticated with public key %s", cmt, fingerprint(key))
-		return nil
+func (s *Server) matchKeys(conn ssh.ConnMetadata, key ssh.PublicKey, keys map[string]AuthorizedKey) (*ssh.Permissions, error) {
+	k, exists := keys[string(key.Marshal())]
+	if !exists {
+		s.debugf("User authentication failed with public key %s", Fingerprint(key))
+		return nil, fmt.Errorf("denied")
+	}
+	perms, err := keyPermissions(k.Options, conn.RemoteAddr())
+	if err != nil {
+		s.debugf("User '%s' denied public key %s (%s)", k.Comment, Fingerprint(key), err)
+		return nil, err
+	}
+	s.debugf("User '%s' authenticated with public key %s", k.Comment, Fingerprint(key))
+	return perms, nil
+}
+
+func (s *Server) authLogCallback(conn ssh.ConnMetadata, method string, err error) {
+	var partial *ssh.PartialSuccessError
+	if err == nil || errors.As(err, &partial) {
+		s.counters.auth(method, true)
+	} else if method != "none" {
+		//clients begin with "none" to discover methods
+		s.counters.auth(method, false)
+	} else {
+		return
+	}
+	attrs := []any{}
+	if method == "publickey" {
+		if fp := s.checkedKey(conn.RemoteAddr()); fp != "" {
+			attrs = append(attrs, "fingerprint", fp)
+		}
 	}
-	s.debugf("User authentication failed with public key %s", fingerprint(key))
-	return fmt.Errorf("denied")
+	s.authLog(conn, method, err, attrs...)
 }
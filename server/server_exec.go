@@ -0,0 +1,170 @@
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// shellCommand returns a command which runs the
+// given command line using the given shell
+func shellCommand(shell, command string) *exec.Cmd {
+	flag := "-c"
+	switch name := strings.ToLower(filepath.Base(shell)); {
+	case strings.HasPrefix(name, "powershell"), strings.HasPrefix(name, "pwsh"):
+		flag = "-Command"
+	case name == "cmd" || name == "cmd.exe":
+		flag = "/C"
+	}
+	return exec.Command(shell, flag, command)
+}
+
+// execPattern compiles an ExecAllowlist entry. Entries beginning
+// with "^" are regular expressions, others are command prefixes,
+// matching whole words (e.g. "rsync --server" matches
+// "rsync --server -e.Lsfx . dir" but not "rsync --serverX").
+// Since commands are run by the shell, arguments after a prefix
+// may not contain shell operators or newlines, which could run
+// other commands.
+func execPattern(entry string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(entry, "^") {
+		return regexp.Compile(entry)
+	}
+	return regexp.Compile(`^` + regexp.QuoteMeta(entry) + "([ \\t][^;&|`$()<>\\n]*)?$")
+}
+
+// execAllowed reports whether the ExecAllowlist permits the command
+func (s *Server) execAllowed(command string) bool {
+	if len(s.execAllow) == 0 {
+		return true
+	}
+	for _, re := range s.execAllow {
+		if re.MatchString(command) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectCommand reports a refused shell or command to the
+// client as a failure, and then closes the channel
+func (s *Server) rejectCommand(sess *session, reason string) {
+	s.debugf("Rejected %s", reason)
+	fmt.Fprintf(sess.channel.Stderr(), "%s\n", reason)
+	sess.channel.SendRequest("exit-status", false, ssh.Marshal(exitStatus{Status: 1}))
+	sess.channel.Close()
+}
+
+// forcedCommand returns the command forced by the authorized key
+// of the session (command="..."), or else by Config.ForceCommand
+func (s *Server) forcedCommand(sess *session) string {
+	if perms := sess.conn.Permissions; perms != nil {
+		if command, ok := perms.Extensions[forceCommandExtension]; ok {
+			return command
+		}
+	}
+	return s.cli.ForceCommand
+}
+
+// runForcedCommand runs the forced command in place of the client's
+// shell or command, which is passed on as SSH_ORIGINAL_COMMAND.
+// Like a shell, the forced command uses a pty when one was requested.
+func (s *Server) runForcedCommand(sess *session, original string) error {
+	if original != "" {
+		sess.env = appendEnv(sess.env, "SSH_ORIGINAL_COMMAND="+original)
+	}
+	return s.runCommand(sess, s.forcedCommand(sess))
+}
+
+// runCommand starts the given command, in a pty when one was
+// requested (e.g. "ssh -t host top"), and otherwise with pipes
+func (s *Server) runCommand(sess *session, command string) error {
+	start := time.Now()
+	var err error
+	if sess.pty {
+		err = s.attachShell(sess, command)
+	} else {
+		err = s.executeCommand(sess, command)
+	}
+	if err == nil && s.cli.AuditWriter != nil {
+		go s.auditExec(sess, command, start)
+	}
+	return err
+}
+
+// executeCommand starts the given command without a pty
+func (s *Server) executeCommand(sess *session, command string) error {
+	shell, dir := s.userShell(sess.user())
+	cmd := shellCommand(shell, command)
+	cmd.Dir = dir
+	return s.runPiped(sess, cmd, command)
+}
+
+// attachPipedShell starts a shell without a pty, for clients which
+// did not request one (e.g. a script piped to "ssh host")
+func (s *Server) attachPipedShell(sess *session) error {
+	shell, dir := s.userShell(sess.user())
+	cmd := exec.Command(shell)
+	cmd.Dir = dir
+	return s.runPiped(sess, cmd, shell)
+}
+
+// runPiped starts the given command with plain pipes. Stdout is
+// written to the channel and stderr to its extended data stream,
+// so clients can tell them apart. Once the command exits, its
+// exit status is sent and the channel is closed.
+func (s *Server) runPiped(sess *session, cmd *exec.Cmd, command string) error {
+	connection := sess.channel
+	cmd.Env = s.sessionEnv(sess, false)
+	if err := s.limitCommand(cmd); err != nil {
+		return err
+	}
+	sent := byteCounter{&s.counters.bytesSent}
+	var stdout io.Writer = io.MultiWriter(connection, sess, sent)
+	var stderr io.Writer = io.MultiWriter(connection.Stderr(), sent)
+	//pause commands which flood their session with output,
+	//with stdout and stderr sharing the one rate
+	if r := s.cli.MaxOutputBytesPerSec; r > 0 {
+		rl := newRateLimiter(r)
+		stdout = rl.writer(stdout)
+		stderr = rl.writer(stderr)
+	}
+	cmd.Stdout = copyWriter{s, stdout}
+	cmd.Stderr = copyWriter{s, stderr}
+	//background processes may hold the pipes open,
+	//so only wait a moment for their output
+	cmd.WaitDelay = drainTimeout
+	newProcessGroup(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("could not start command (%s)", err)
+	}
+	//the command is only ever waited on by the reaper
+	proc := reap(cmd)
+	sess.setProc(proc)
+	s.debugf("Command started: %s", command)
+	go func() {
+		s.copyBuffer(io.MultiWriter(stdin, byteCounter{&s.counters.bytesReceived}), connection)
+		stdin.Close()
+	}()
+	go func() {
+		// The reaper waits for all output to be copied,
+		// so the exit status is sent after the output
+		req, payload := proc.exitRequest()
+		if _, err := connection.SendRequest(req, false, payload); err == nil {
+			s.debugf("Sent %s", req)
+		}
+		connection.Close()
+		s.debugf("Command exited: %s", command)
+	}()
+	return nil
+}
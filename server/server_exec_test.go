@@ -0,0 +1,231 @@
+package sshd
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestExecAllowlist(t *testing.T) {
+	s, err := NewServer(&Config{
+		AuthType:      "foo:bar",
+		ExecAllowlist: []string{"echo allowed", "^printf [a-z]+$"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for command, ok := range map[string]bool{
+		"echo allowed":          true,
+		"echo allowed and more": true,
+		"echo allowedx":         false,
+		"echo allowed; id":      false,
+		"echo allowed && id":    false,
+		"echo allowed | sh":     false,
+		"echo allowed $(id)":    false,
+		"echo allowed `id`":     false,
+		"echo allowed\nid":      false,
+		"echo allowed x\nid":    false,
+		"printf abc":            true,
+		"printf abc1":           false,
+		"id":                    false,
+		"":                      false,
+	} {
+		if s.execAllowed(command) != ok {
+			t.Errorf("%q: expected allowed %v", command, ok)
+		}
+	}
+	client, err := dial(serve(t, s), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if out, err := run(t, client, "echo allowed"); err != nil || out != "allowed\n" {
+		t.Errorf("unexpected output %q (%v)", out, err)
+	}
+	var exitErr *ssh.ExitError
+	if _, err := run(t, client, "id"); !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+		t.Errorf("expected the command to be rejected, got %v", err)
+	}
+	//shells are refused too
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Wait(); !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+		t.Errorf("expected the shell to be rejected, got %v", err)
+	}
+}
+
+func TestForceCommandAllowlist(t *testing.T) {
+	addr := startServer(t, &Config{
+		AuthType:      "foo:bar",
+		ExecAllowlist: []string{"echo allowed"},
+		ForceCommand:  "echo forced:$SSH_ORIGINAL_COMMAND",
+	})
+	client, err := dial(addr, "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	//the forced command runs in place of any command...
+	for _, command := range []string{"echo allowed", "ls"} {
+		out, err := run(t, client, command)
+		if err != nil || strings.TrimSpace(out) != "forced:"+command {
+			t.Errorf("%s: unexpected output %q (%v)", command, out, err)
+		}
+	}
+	//...and of shells
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	var out strings.Builder
+	sess.Stdout = &out
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Wait(); err != nil || strings.TrimSpace(out.String()) != "forced:" {
+		t.Errorf("shell: unexpected output %q (%v)", out.String(), err)
+	}
+}
+
+func TestForceCommandPty(t *testing.T) {
+	addr := startServer(t, &Config{AuthType: "foo:bar", ForceCommand: "sleep 0.3; echo forced-out"})
+	client, err := dial(addr, "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sess.RequestPty("xterm", 24, 80, nil); err != nil {
+			t.Fatal(err)
+		}
+		//without stdin, the client sends EOF right away,
+		//which must not hang up the command
+		out, err := sess.Output("ls")
+		if err != nil || !strings.Contains(string(out), "forced-out") {
+			t.Errorf("run %d: unexpected output %q (%v)", i, out, err)
+		}
+		sess.Close()
+	}
+}
+
+func TestExecStderr(t *testing.T) {
+	client, err := dial(startServer(t, &Config{AuthType: "foo:bar"}), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	var stdout, stderr strings.Builder
+	sess.Stdout = &stdout
+	sess.Stderr = &stderr
+	if err := sess.Run("echo out; echo err >&2"); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Errorf("unexpected stdout %q and stderr %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestExecPty(t *testing.T) {
+	client, err := dial(startServer(t, &Config{AuthType: "foo:bar"}), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, pty := range []bool{false, true} {
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pty {
+			if err := sess.RequestPty("xterm", 24, 80, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		//like "ssh -t host tty"
+		out, _ := sess.Output("tty")
+		if got := !strings.Contains(string(out), "not a tty"); got != pty {
+			t.Errorf("pty %v: unexpected output %q", pty, out)
+		}
+		sess.Close()
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestAudit(t *testing.T) {
+	events := make(chan auditEvent, 10)
+	audit := writerFunc(func(p []byte) (int, error) {
+		var e auditEvent
+		if err := json.Unmarshal(p, &e); err != nil {
+			t.Errorf("invalid audit event %q", p)
+		}
+		events <- e
+		return len(p), nil
+	})
+	next := func() auditEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("missing audit event")
+		}
+		return auditEvent{}
+	}
+	for _, c := range []struct {
+		config  Config
+		pty     bool
+		command string
+		want    auditEvent
+	}{
+		{Config{ExecAllowlist: []string{"echo"}}, false, "echo hi", auditEvent{Command: "echo hi"}},
+		{Config{ExecAllowlist: []string{"echo"}}, true, "echo hi", auditEvent{Command: "echo hi"}},
+		{Config{ExecAllowlist: []string{"echo"}}, false, "exit 3", auditEvent{Command: "exit 3", ExitCode: 1, Rejected: true}},
+		{Config{ForceCommand: "exit 2"}, true, "echo hi", auditEvent{Command: "exit 2", ExitCode: 2}},
+	} {
+		config := c.config
+		config.AuthType = "foo:bar"
+		config.AuditWriter = audit
+		client, err := dial(startServer(t, &config), "foo", ssh.Password("bar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.pty {
+			if err := sess.RequestPty("xterm", 24, 80, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sess.Run(c.command)
+		e := next()
+		if e.Command != c.want.Command || e.ExitCode != c.want.ExitCode || e.Rejected != c.want.Rejected ||
+			e.User != "foo" || e.Session == "" || e.Remote == "" || e.Time.IsZero() {
+			t.Errorf("%q (pty %v): unexpected audit event %+v", c.command, c.pty, e)
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,679 @@
+package sshd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startServer serves c on a random local port, until the test ends
+func startServer(t *testing.T, c *Config) string {
+	t.Helper()
+	s, err := NewServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serve(t, s)
+}
+
+func serve(t *testing.T, s *Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.StartWith(l)
+	return l.Addr().String()
+}
+
+// newSigner generates a client key
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// writeAuthorizedKeys writes an authorized keys file with the given
+// lines, where a signer is written as its public key
+func writeAuthorizedKeys(t *testing.T, lines ...any) string {
+	t.Helper()
+	b := []byte{}
+	for _, l := range lines {
+		switch l := l.(type) {
+		case ssh.Signer:
+			b = append(b, ssh.MarshalAuthorizedKey(l.PublicKey())...)
+		case string:
+			b = append(b, l+"\n"...)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func dial(addr, user string, auth ...ssh.AuthMethod) (*ssh.Client, error) {
+	return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+}
+
+// run runs command over a new session of the client
+func run(t *testing.T, client *ssh.Client, command string) (string, error) {
+	t.Helper()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	out, err := sess.Output(command)
+	return string(out), err
+}
+
+func TestCopyBufferPiped(t *testing.T) {
+	s, err := NewServer(&Config{AuthType: "foo:bar", CopyBufferSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//command output is copied by os/exec, which must use the buffer
+	var sizes []int
+	cmd := exec.Command("head", "-c", "100000", "/dev/zero")
+	cmd.Stdout = copyWriter{s, writerFunc(func(p []byte) (int, error) {
+		sizes = append(sizes, len(p))
+		return len(p), nil
+	})}
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, n := range sizes {
+		if n > 1000 {
+			t.Fatalf("write of %d bytes", n)
+		}
+		total += n
+	}
+	if total != 100000 {
+		t.Errorf("copied %d bytes", total)
+	}
+}
+
+func BenchmarkCopyBuffer(b *testing.B) {
+	const size = 8 << 20
+	for _, n := range []int{0, 4 << 10, 32 << 10, 256 << 10} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			s, err := NewServer(&Config{
+				AuthType:       "foo:bar",
+				Shell:          "sh",
+				CopyBufferSize: n,
+				//forced commands use a pty, when requested
+				ForceCommand: fmt.Sprintf("head -c %d /dev/zero", size),
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer l.Close()
+			go s.StartWith(l)
+			client, err := dial(l.Addr().String(), "foo", ssh.Password("bar"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer client.Close()
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sess, err := client.NewSession()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := sess.RequestPty("xterm", 24, 80, nil); err != nil {
+					b.Fatal(err)
+				}
+				out, err := sess.StdoutPipe()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := sess.Start(""); err != nil {
+					b.Fatal(err)
+				}
+				if n, _ := io.Copy(io.Discard, out); n < size {
+					b.Fatalf("short output, %d bytes", n)
+				}
+				sess.Wait()
+				sess.Close()
+			}
+		})
+	}
+}
+
+func TestMalformedRequests(t *testing.T) {
+	client, err := dial(startServer(t, &Config{AuthType: "foo:bar"}), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	str := func(s string) []byte { return ssh.Marshal(struct{ S string }{s}) }
+	for _, c := range []struct {
+		name, req string
+		payload   []byte
+	}{
+		{"empty pty-req", "pty-req", nil},
+		{"truncated pty-req", "pty-req", []byte{0, 0, 0, 5, 'x', 't'}},
+		{"pty-req without size", "pty-req", str("xterm")},
+		{"pty-req with trailing data", "pty-req", append(ssh.Marshal(ptyRequest{Term: "xterm", Columns: 80, Rows: 24}), 0xff)},
+		{"short window-change", "window-change", []byte{0, 0, 0, 80}},
+		{"empty env", "env", nil},
+		{"env without value", "env", str("FOO")},
+		{"env without name", "env", ssh.Marshal(struct{ Name, Value string }{"", "x"})},
+		{"env name with =", "env", ssh.Marshal(struct{ Name, Value string }{"A=B", "x"})},
+		{"empty exec", "exec", nil},
+		{"truncated exec", "exec", []byte{0, 0, 0, 9, 'e'}},
+		{"truncated subsystem", "subsystem", []byte{0, 0}},
+		{"truncated signal", "signal", []byte{0, 0, 0, 3}},
+		{"truncated x11-req", "x11-req", []byte{1}},
+		{"unknown", "foo@example.com", nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ch, reqs, err := client.OpenChannel("session", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ch.Close()
+			go ssh.DiscardRequests(reqs)
+			ok, err := ch.SendRequest(c.req, true, c.payload)
+			if err != nil {
+				t.Fatalf("expected a reply, got %s", err)
+			}
+			if ok {
+				t.Error("expected the request to be refused")
+			}
+		})
+	}
+	//a session runs only one shell or command
+	t.Run("second shell", func(t *testing.T) {
+		ch, reqs, err := client.OpenChannel("session", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ch.Close()
+		go ssh.DiscardRequests(reqs)
+		if ok, err := ch.SendRequest("exec", true, str("sleep 1")); err != nil || !ok {
+			t.Fatalf("expected exec to start, got %v %v", ok, err)
+		}
+		for _, req := range []string{"shell", "exec"} {
+			payload := str("id")
+			if req == "shell" {
+				payload = nil
+			}
+			if ok, err := ch.SendRequest(req, true, payload); err != nil || ok {
+				t.Errorf("%s: expected a refusal, got %v %v", req, ok, err)
+			}
+		}
+	})
+	//and the connection still works
+	if out, err := run(t, client, "echo ok"); err != nil || out != "ok\n" {
+		t.Fatalf("unexpected output %q (%v)", out, err)
+	}
+}
+
+// anyUser accepts any username with the password "bar"
+func anyUser(user, password string, remote net.Addr) (bool, error) {
+	return password == "bar", nil
+}
+
+func TestUserOverrides(t *testing.T) {
+	dir := t.TempDir()
+	addr := startServer(t, &Config{
+		AuthType:     "password",
+		PasswordAuth: anyUser,
+		Shell:        "bash",
+		UserOverrides: map[string]UserConfig{
+			"alice": {Shell: "sh", WorkDir: dir, Env: []string{"ROLE=alice"}},
+		},
+	})
+	for user, want := range map[string]string{
+		"alice": "sh " + dir + " alice",
+		"bob":   "bash " + mustGetwd(t) + " ",
+	} {
+		client, err := dial(addr, user, ssh.Password("bar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := run(t, client, "echo ${0##*/} $PWD $ROLE")
+		client.Close()
+		if err != nil || strings.TrimSpace(out) != strings.TrimSpace(want) {
+			t.Errorf("%s: expected %q, got %q (%v)", user, want, out, err)
+		}
+	}
+}
+
+func TestUserEnv(t *testing.T) {
+	addr := startServer(t, &Config{
+		AuthType:     "password",
+		PasswordAuth: anyUser,
+		UserEnv:      map[string][]string{"alice": {"ROLE=admin"}},
+		UserOverrides: map[string]UserConfig{
+			//applied after UserEnv
+			"carol": {Env: []string{"ROLE=carol"}},
+		},
+	})
+	for user, want := range map[string]string{"alice": "admin", "bob": "client", "carol": "carol"} {
+		client, err := dial(addr, user, ssh.Password("bar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		//forced vars override the client's
+		sess.Setenv("ROLE", "client")
+		out, err := sess.Output("echo $ROLE")
+		client.Close()
+		if err != nil || strings.TrimSpace(string(out)) != want {
+			t.Errorf("%s: expected %q, got %q (%v)", user, want, out, err)
+		}
+	}
+}
+
+func mustGetwd(t *testing.T) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wd
+}
+
+// freePort returns an unused port of the given local host,
+// skipping the test when the host cannot be listened on
+func freePort(t *testing.T, host string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Skipf("cannot listen on %s (%s)", host, err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+// startContext runs s.StartContext, and returns a func which
+// cancels its context and returns its error
+func startContext(t *testing.T, s *Server) func() error {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- s.StartContext(ctx) }()
+	t.Cleanup(cancel)
+	return func() error {
+		cancel()
+		select {
+		case err := <-errs:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("server not stopped")
+		}
+		return nil
+	}
+}
+
+// dialRetry dials addr until the server is listening
+func dialRetry(t *testing.T, addr string) *ssh.Client {
+	t.Helper()
+	for i := 0; ; i++ {
+		client, err := dial(addr, "foo", ssh.Password("bar"))
+		if err == nil {
+			t.Cleanup(func() { client.Close() })
+			return client
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestListenIPv6(t *testing.T) {
+	for _, host := range []string{"::1", "[::1]"} {
+		port := freePort(t, "::1")
+		s, err := NewServer(&Config{AuthType: "foo:bar", Host: host, Port: port})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stop := startContext(t, s)
+		client := dialRetry(t, net.JoinHostPort("::1", port))
+		if out, err := run(t, client, "echo ok"); err != nil || out != "ok\n" {
+			t.Errorf("%s: unexpected output %q (%v)", host, out, err)
+		}
+		stop()
+	}
+}
+
+func TestStartContext(t *testing.T) {
+	port := freePort(t, "127.0.0.1")
+	s, err := NewServer(&Config{AuthType: "foo:bar", Host: "127.0.0.1", Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := startContext(t, s)
+	addr := net.JoinHostPort("127.0.0.1", port)
+	client := dialRetry(t, addr)
+	//cancelling stops the server, which is not an error
+	if err := stop(); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+	if _, err := dial(addr, "foo", ssh.Password("bar")); err == nil {
+		t.Error("expected the listener to be closed")
+	}
+	//established connections are left to finish
+	if out, err := run(t, client, "echo ok"); err != nil || out != "ok\n" {
+		t.Errorf("unexpected output %q (%v)", out, err)
+	}
+}
+
+func TestConnectionFilter(t *testing.T) {
+	addr := startServer(t, &Config{
+		AuthType: "foo:bar",
+		ConnectionFilter: func(conn net.Conn) error {
+			if remoteIP(conn.RemoteAddr()) == "127.0.0.2" {
+				return fmt.Errorf("blocked")
+			}
+			return nil
+		},
+	})
+	if client, err := dial(addr, "foo", ssh.Password("bar")); err != nil {
+		t.Fatal(err)
+	} else {
+		client.Close()
+	}
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot dial from 127.0.0.2 (%s)", err)
+	}
+	defer conn.Close()
+	//dropped before the server sends its version
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, err := io.ReadAll(conn); err != nil || len(b) != 0 {
+		t.Errorf("expected the connection to be closed, got %q (%v)", b, err)
+	}
+}
+
+func TestMaxChannelsPerConn(t *testing.T) {
+	client, err := dial(startServer(t, &Config{AuthType: "foo:bar", MaxChannelsPerConn: 2}), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var sessions []*ssh.Session
+	for i := 0; i < 2; i++ {
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, sess)
+	}
+	_, err = client.NewSession()
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) || openErr.Reason != ssh.ResourceShortage {
+		t.Fatalf("expected a resource shortage, got %v", err)
+	}
+	//closing a channel makes room for another
+	sessions[0].Close()
+	for i := 0; ; i++ {
+		sess, err := client.NewSession()
+		if err == nil {
+			sess.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatalf("expected a channel once one was closed, got %s", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	sessions[1].Close()
+}
+
+func TestBanner(t *testing.T) {
+	banner := func(addr string) string {
+		var got string
+		client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User:            "foo",
+			Auth:            []ssh.AuthMethod{ssh.Password("bar")},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			BannerCallback: func(message string) error {
+				got = message
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+		return got
+	}
+	if got := banner(startServer(t, &Config{AuthType: "foo:bar", Banner: "Authorized use only\n"})); got != "Authorized use only\n" {
+		t.Errorf("unexpected banner %q", got)
+	}
+	//files are shown, and reloaded once modified
+	path := filepath.Join(t.TempDir(), "banner")
+	if err := os.WriteFile(path, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, &Config{AuthType: "foo:bar", Banner: path})
+	if got := banner(addr); got != "first\n" {
+		t.Errorf("unexpected banner %q", got)
+	}
+	if err := os.WriteFile(path, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if got := banner(addr); got != "second\n" {
+		t.Errorf("expected the updated banner, got %q", got)
+	}
+	//the last banner is kept should the file be removed
+	os.Remove(path)
+	if got := banner(addr); got != "second\n" {
+		t.Errorf("expected the last banner, got %q", got)
+	}
+}
+
+func TestSubsystemRefused(t *testing.T) {
+	client, err := dial(startServer(t, &Config{AuthType: "foo:bar"}), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	stderr, _ := sess.StderrPipe()
+	//like "sftp host"
+	if err := sess.RequestSubsystem("sftp"); err == nil {
+		t.Fatal("expected the subsystem to be refused")
+	}
+	sess.Close()
+	b, _ := io.ReadAll(stderr)
+	if string(b) != "subsystem sftp is not supported by this server\n" {
+		t.Errorf("unexpected stderr %q", b)
+	}
+}
+
+// stallConn discards writes once stalled, like
+// a client which has stopped responding
+type stallConn struct {
+	net.Conn
+	stalled atomic.Bool
+}
+
+func (c *stallConn) Write(p []byte) (int, error) {
+	if c.stalled.Load() {
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+func TestConnKeepAlive(t *testing.T) {
+	addr := startServer(t, &Config{AuthType: "foo:bar", KeepAlive: 1, KeepAliveMaxMissed: 1})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc := &stallConn{Conn: conn}
+	c, chans, reqs, err := ssh.NewClientConn(sc, addr, &ssh.ClientConfig{
+		User:            "foo",
+		Auth:            []ssh.AuthMethod{ssh.Password("bar")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go func() {
+		for nc := range chans {
+			nc.Reject(ssh.Prohibited, "")
+		}
+	}()
+	keepalives := make(chan bool, 10)
+	go func() {
+		for r := range reqs {
+			if r.Type == "keepalive@openssh.com" {
+				keepalives <- true
+			}
+			r.Reply(false, nil)
+		}
+	}()
+	closed := make(chan error, 1)
+	go func() { closed <- c.Wait() }()
+	//keep alives are sent, and answered ones keep the connection open
+	for i := 0; i < 3; i++ {
+		select {
+		case <-keepalives:
+		case err := <-closed:
+			t.Fatalf("connection closed (%v)", err)
+		case <-time.After(3 * time.Second):
+			t.Fatal("missing keep alive")
+		}
+	}
+	//once unanswered, the connection is closed
+	sc.stalled.Store(true)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+func TestListenMany(t *testing.T) {
+	addrs := []string{
+		net.JoinHostPort("127.0.0.1", freePort(t, "127.0.0.1")),
+		net.JoinHostPort("127.0.0.1", freePort(t, "127.0.0.1")),
+	}
+	s, err := NewServer(&Config{AuthType: "foo:bar", Listen: addrs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := startContext(t, s)
+	for _, addr := range addrs {
+		client := dialRetry(t, addr)
+		if out, err := run(t, client, "echo ok"); err != nil || out != "ok\n" {
+			t.Errorf("%s: unexpected output %q (%v)", addr, out, err)
+		}
+	}
+	//stopping closes every listener
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		if _, err := dial(addr, "foo", ssh.Password("bar")); err == nil {
+			t.Errorf("%s: expected the listener to be closed", addr)
+		}
+	}
+	//an address in use fails the server
+	l, err := net.Listen("tcp", addrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := s.StartContext(context.Background()); err == nil {
+		t.Error("expected an error for an address in use")
+	}
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	client, err := dial(startServer(t, &Config{AuthType: "foo:bar"}), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	//some clients treat a failed keep alive as fatal
+	ok, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+	if err != nil || !ok {
+		t.Errorf("expected keep alives to succeed, got %v (%v)", ok, err)
+	}
+	//other global requests are refused
+	if ok, _, err := client.SendRequest("unknown@example.com", true, nil); err != nil || ok {
+		t.Errorf("expected unknown requests to fail, got %v (%v)", ok, err)
+	}
+}
+
+func TestSessionStartTimeout(t *testing.T) {
+	client, err := dial(startServer(t, &Config{AuthType: "foo:bar", SessionStartTimeout: 1}), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	//an idle channel is closed
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ssh.DiscardRequests(reqs)
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, ch)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the idle channel to be closed")
+	}
+	//a started session outlives the timeout
+	out, err := run(t, client, "sleep 2 && echo ok")
+	if err != nil || strings.TrimSpace(out) != "ok" {
+		t.Fatalf("expected ok, got %q (%v)", out, err)
+	}
+}
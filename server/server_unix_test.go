@@ -0,0 +1,75 @@
+//go:build !windows
+
+package sshd
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+func TestTuneConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, delay := range []bool{false, true} {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewServer(&Config{AuthType: "foo:bar", TCPDelay: delay})
+		if err != nil {
+			t.Fatal(err)
+		}
+		//go sets TCP_NODELAY by default, so start from the opposite
+		tc := conn.(*net.TCPConn)
+		tc.SetNoDelay(delay)
+		s.tuneConn(tc)
+		raw, _ := tc.SyscallConn()
+		nodelay := -1
+		raw.Control(func(fd uintptr) {
+			nodelay, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_NODELAY)
+		})
+		if (nodelay != 0) == delay {
+			t.Errorf("delay %v: unexpected TCP_NODELAY %d", delay, nodelay)
+		}
+		conn.Close()
+		client.Close()
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	s, err := NewServer(&Config{AuthType: "foo:bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "sshd.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.StartWith(l)
+	//unix connections are served without tuning
+	client, err := ssh.Dial("unix", path, &ssh.ClientConfig{
+		User:            "foo",
+		Auth:            []ssh.AuthMethod{ssh.Password("bar")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if out, err := run(t, client, "echo ok"); err != nil || out != "ok\n" {
+		t.Errorf("unexpected output %q (%v)", out, err)
+	}
+}
@@ -0,0 +1,271 @@
+package sshd
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultTerm = "xterm-256color"
+
+// session is the state of a single "session" channel
+type session struct {
+	id      string
+	created time.Time
+	conn    *ssh.ServerConn
+	channel ssh.Channel
+	env     []string
+	resizes chan []byte
+	started bool
+	//closes the session if it is not started in time
+	startTimer *time.Timer
+	//the shell or command, once started
+	proc *process
+	//the forwarded agent socket, if requested
+	agent net.Listener
+	//the forwarded x11 display, if requested
+	x11 net.Listener
+	//terminal type, from the pty-req and the env
+	pty     bool
+	ptyTerm string
+	envTerm string
+	//terminal size, from the pty-req and window changes
+	cols, rows uint32
+	//terminal modes, from the pty-req
+	modes ssh.TerminalModes
+	//character set of the session locale
+	charset string
+	//live output watchers
+	mut      sync.Mutex
+	closed   bool
+	done     chan struct{}
+	watchers map[*watcher]bool
+	//recent output, replayed to new watchers
+	scrollback *scrollback
+}
+
+const defaultScrollback = 64 << 10
+
+func newSession(conn *ssh.ServerConn, channel ssh.Channel, env []string) *session {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &session{
+		id:       fmt.Sprintf("%x", b),
+		created:  time.Now(),
+		conn:     conn,
+		channel:  channel,
+		env:      env,
+		resizes:  make(chan []byte, 1),
+		done:     make(chan struct{}),
+		watchers: map[*watcher]bool{},
+	}
+}
+
+// start marks the session as running a shell or command
+func (sess *session) start() {
+	sess.started = true
+	if sess.startTimer != nil {
+		sess.startTimer.Stop()
+	}
+}
+
+// setProc records the shell or command of the session
+func (sess *session) setProc(proc *process) {
+	sess.mut.Lock()
+	sess.proc = proc
+	sess.mut.Unlock()
+}
+
+// setPty records that the session has a terminal, of the given size
+func (sess *session) setPty(cols, rows uint32) {
+	sess.mut.Lock()
+	sess.pty = true
+	sess.cols, sess.rows = cols, rows
+	sess.mut.Unlock()
+}
+
+// setSize records the terminal size of the session
+func (sess *session) setSize(cols, rows uint32) {
+	sess.mut.Lock()
+	sess.cols, sess.rows = cols, rows
+	sess.mut.Unlock()
+}
+
+// info describes the session, see Server.ActiveSessions
+func (sess *session) info() SessionInfo {
+	sess.mut.Lock()
+	defer sess.mut.Unlock()
+	return SessionInfo{
+		ID:         sess.id,
+		User:       sess.user(),
+		RemoteAddr: sess.conn.RemoteAddr().String(),
+		Start:      sess.created,
+		Pty:        sess.pty,
+		Cols:       sess.cols,
+		Rows:       sess.rows,
+		Charset:    sess.charset,
+	}
+}
+
+// kill ends the shell or command of the session, and closes it
+func (sess *session) kill() {
+	sess.mut.Lock()
+	proc := sess.proc
+	sess.mut.Unlock()
+	if proc != nil && proc.signal("KILL") == nil {
+		//once reaped, the exit signal is sent and the channel closed
+		select {
+		case <-proc.done:
+			return
+		case <-time.After(drainTimeout):
+		}
+	}
+	sess.channel.Close()
+}
+
+// user is the authenticated username of the session
+func (sess *session) user() string {
+	return sess.conn.User()
+}
+
+// term resolves the terminal type of the session. A forced term
+// takes precedence, then the authoritative pty-req term, then
+// a TERM env request, then the default.
+func (sess *session) term(force string) string {
+	switch {
+	case force != "":
+		return force
+	case sess.ptyTerm != "":
+		return sess.ptyTerm
+	case sess.envTerm != "":
+		return sess.envTerm
+	}
+	return defaultTerm
+}
+
+// localeCharset returns the character set of the locale in
+// the given env, using the first of LC_ALL, LC_CTYPE and LANG
+// that is set. For example "en_US.UTF-8" has charset "UTF-8".
+func localeCharset(env []string) string {
+	for _, name := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		locale := getEnv(env, name)
+		if locale == "" {
+			continue
+		}
+		//language[_territory][.codeset][@modifier]
+		locale, _, _ = strings.Cut(locale, "@")
+		_, codeset, ok := strings.Cut(locale, ".")
+		if !ok {
+			//C, POSIX and bare languages use the portable charset
+			return "US-ASCII"
+		}
+		codeset = strings.ToUpper(codeset)
+		if codeset == "UTF8" {
+			codeset = "UTF-8"
+		}
+		return codeset
+	}
+	return ""
+}
+
+// resize queues a window size payload without blocking. Only
+// the latest size matters, so any pending resize is replaced.
+func (sess *session) resize(payload []byte) {
+	for {
+		select {
+		case sess.resizes <- payload:
+			return
+		default:
+		}
+		//drop the stale resize
+		select {
+		case <-sess.resizes:
+		default:
+		}
+	}
+}
+
+// Write copies session output to all watchers. Watchers
+// which fall behind miss output, rather than blocking
+// the session. Write never fails.
+func (sess *session) Write(p []byte) (int, error) {
+	sess.mut.Lock()
+	defer sess.mut.Unlock()
+	sess.scrollback.write(p)
+	for w := range sess.watchers {
+		b := make([]byte, len(p))
+		copy(b, p)
+		select {
+		case w.queue <- b:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// watch returns a reader of the scrollback, followed by
+// future session output
+func (sess *session) watch() (io.ReadCloser, error) {
+	sess.mut.Lock()
+	defer sess.mut.Unlock()
+	if sess.closed {
+		return nil, fmt.Errorf("session closed")
+	}
+	r, pw := io.Pipe()
+	w := &watcher{queue: make(chan []byte, 64)}
+	if b := sess.scrollback.bytes(); len(b) > 0 {
+		w.queue <- b
+	}
+	sess.watchers[w] = true
+	go func() {
+		for b := range w.queue {
+			if _, err := pw.Write(b); err != nil {
+				//reader closed, stop watching
+				sess.unwatch(w)
+				break
+			}
+		}
+		pw.Close()
+	}()
+	return r, nil
+}
+
+func (sess *session) unwatch(w *watcher) {
+	sess.mut.Lock()
+	defer sess.mut.Unlock()
+	if sess.watchers[w] {
+		delete(sess.watchers, w)
+		close(w.queue)
+	}
+}
+
+// close ends all watchers and forwarding, once the
+// channel of the session is closed
+func (sess *session) close() {
+	if sess.agent != nil {
+		sess.agent.Close()
+	}
+	if sess.x11 != nil {
+		sess.x11.Close()
+	}
+	sess.mut.Lock()
+	defer sess.mut.Unlock()
+	if !sess.closed {
+		close(sess.done)
+	}
+	sess.closed = true
+	for w := range sess.watchers {
+		delete(sess.watchers, w)
+		close(w.queue)
+	}
+}
+
+type watcher struct {
+	queue chan []byte
+}
@@ -0,0 +1,503 @@
+//go:build !windows
+
+package sshd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKillSession(t *testing.T) {
+	s, err := NewServer(&Config{AuthType: "foo:bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := dial(serve(t, s), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, pty := range []bool{false, true} {
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pty {
+			if err := sess.RequestPty("xterm", 24, 80, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		//the sleep must be killed too, not only the shell
+		if err := sess.Start("sleep 5; true"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(300 * time.Millisecond)
+		list := s.ActiveSessions()
+		if len(list) != 1 || list[0].User != "foo" || list[0].Pty != pty {
+			t.Fatalf("pty %v: unexpected sessions %+v", pty, list)
+		}
+		start := time.Now()
+		if err := s.KillSession(list[0].ID); err != nil {
+			t.Fatal(err)
+		}
+		err = sess.Wait()
+		var exitErr *ssh.ExitError
+		if !errors.As(err, &exitErr) || exitErr.Signal() != "KILL" {
+			t.Errorf("pty %v: expected exit signal KILL, got %v", pty, err)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("pty %v: exited after %s", pty, d)
+		}
+		sess.Close()
+		time.Sleep(100 * time.Millisecond)
+		if n := len(s.ActiveSessions()); n != 0 {
+			t.Errorf("pty %v: %d sessions left", pty, n)
+		}
+	}
+	if err := s.KillSession("missing"); err == nil {
+		t.Error("expected an error for a missing session")
+	}
+}
+
+func TestLocaleCharset(t *testing.T) {
+	for _, c := range []struct {
+		env  []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"LANG=en_US.UTF-8"}, "UTF-8"},
+		{[]string{"LANG=de_DE.utf8@euro"}, "UTF-8"},
+		{[]string{"LANG=C"}, "US-ASCII"},
+		{[]string{"LANG=en_US.UTF-8", "LC_CTYPE=ru_RU.KOI8-R"}, "KOI8-R"},
+		{[]string{"LC_CTYPE=ru_RU.KOI8-R", "LC_ALL=POSIX"}, "US-ASCII"},
+	} {
+		if got := localeCharset(c.env); got != c.want {
+			t.Errorf("%v: expected %q, got %q", c.env, c.want, got)
+		}
+	}
+}
+
+func TestSessionCharset(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewServer(&Config{AuthType: "foo:bar", SessionRecordDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := dial(serve(t, s), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := sess.Setenv("LANG", "en_US.UTF-8"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	list := s.ActiveSessions()
+	if len(list) != 1 || list[0].Charset != "UTF-8" {
+		t.Fatalf("unexpected sessions %+v", list)
+	}
+	stdin.Write([]byte("exit\n"))
+	sess.Wait()
+	//the recording keeps the locale of the session
+	casts, _ := filepath.Glob(filepath.Join(dir, "*.cast"))
+	if len(casts) != 1 {
+		t.Fatalf("expected 1 recording, got %v", casts)
+	}
+	f, err := os.Open(casts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var header castHeader
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() || json.Unmarshal(sc.Bytes(), &header) != nil {
+		t.Fatal("missing recording header")
+	}
+	if header.Env["LANG"] != "en_US.UTF-8" {
+		t.Errorf("unexpected recording env %v", header.Env)
+	}
+}
+
+func TestResizeCoalesced(t *testing.T) {
+	sess := newSession(nil, nil, nil)
+	//never blocks, with no shell to dequeue
+	for i := 0; i < 100; i++ {
+		sess.resize([]byte{byte(i)})
+	}
+	if p := <-sess.resizes; p[0] != 99 {
+		t.Errorf("expected the latest resize, got %d", p[0])
+	}
+	select {
+	case p := <-sess.resizes:
+		t.Errorf("unexpected stale resize %d", p[0])
+	default:
+	}
+}
+
+func TestResizeBeforeShell(t *testing.T) {
+	client, err := dial(startServer(t, &Config{AuthType: "foo:bar"}), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := sess.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatal(err)
+	}
+	//more resizes than were ever queued, the last applies
+	for i := 0; i < 50; i++ {
+		if err := sess.WindowChange(10+i, 100+i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out strings.Builder
+	sess.Stdout = &out
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	stdin.Write([]byte("stty size; exit\n"))
+	sess.Wait()
+	if !strings.Contains(out.String(), "59 149") {
+		t.Errorf("expected the last size, got:\n%s", out.String())
+	}
+}
+
+func TestDisconnectHangsUpShell(t *testing.T) {
+	client, err := dial(startServer(t, &Config{AuthType: "foo:bar"}), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "pid")
+	stdin.Write([]byte("echo $$ > " + path + "; sleep 30\n"))
+	var pid int
+	for i := 0; i < 50 && pid == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+		b, _ := os.ReadFile(path)
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+	}
+	if pid == 0 {
+		t.Fatal("shell did not start")
+	}
+	client.Close()
+	for i := 0; syscall.Kill(pid, 0) == nil; i++ {
+		if i == 50 {
+			t.Fatal("shell still running after the client disconnected")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// readUntil reads r until its output contains want
+func readUntil(t *testing.T, r io.Reader, want string) string {
+	t.Helper()
+	found := make(chan string, 1)
+	go func() {
+		var out []byte
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Read(buf)
+			out = append(out, buf[:n]...)
+			if strings.Contains(string(out), want) || err != nil {
+				found <- string(out)
+				return
+			}
+		}
+	}()
+	select {
+	case out := <-found:
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q, got %q", want, out)
+		}
+		return out
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %q", want)
+	}
+	return ""
+}
+
+func TestScrollbackReplay(t *testing.T) {
+	s, err := NewServer(&Config{AuthType: "foo:bar", ScrollbackBytes: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := dial(serve(t, s), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	stdout, _ := sess.StdoutPipe()
+	if err := sess.Start("echo dropped; echo before; sleep 5"); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, stdout, "before\n")
+	//attaching after the output replays its end
+	w, err := s.WatchSession(s.ActiveSessions()[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if out := readUntil(t, w, "before\n"); out != "ed\nbefore\n" {
+		t.Errorf("unexpected scrollback %q", out)
+	}
+}
+
+func TestWatchSession(t *testing.T) {
+	s, err := NewServer(&Config{AuthType: "foo:bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := dial(serve(t, s), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	time.Sleep(100 * time.Millisecond)
+	w, err := s.WatchSession(s.ActiveSessions()[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	//output is seen as it is produced
+	if err := sess.Start("echo first; sleep 0.5; echo second; sleep 5"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	readUntil(t, w, "first\n")
+	if d := time.Since(start); d > 400*time.Millisecond {
+		t.Errorf("output seen after %s", d)
+	}
+	readUntil(t, w, "second\n")
+	if _, err := s.WatchSession("missing"); err == nil {
+		t.Error("expected an error for a missing session")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	client, err := dial(startServer(t, &Config{AuthType: "foo:bar", IdleTimeout: 1}), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := sess.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatal(err)
+	}
+	stdout, _ := sess.StdoutPipe()
+	//the session is closed even though the hangup is ignored
+	if err := sess.Start("trap '' HUP; sleep 5"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	readUntil(t, stdout, "auto-logout")
+	done := make(chan error, 1)
+	go func() { done <- sess.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("session not closed")
+	}
+	if d := time.Since(start); d < 900*time.Millisecond {
+		t.Errorf("closed after %s", d)
+	}
+}
+
+func TestServerCloseExitSignal(t *testing.T) {
+	client, err := dial(startServer(t, &Config{AuthType: "foo:bar", IdleTimeout: 1}), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := sess.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatal(err)
+	}
+	//the input is left open, the server hangs up the idle shell
+	if _, err := sess.StdinPipe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	err = sess.Wait()
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.Signal() != "HUP" {
+		t.Errorf("expected exit signal HUP, got %v", err)
+	}
+}
+
+func TestSessionTerm(t *testing.T) {
+	for _, c := range []struct {
+		force, pty, env string
+		want            string
+	}{
+		{"", "vt100", "dumb", "vt100"},
+		{"", "vt100", "", "vt100"},
+		{"", "", "dumb", "dumb"},
+		{"", "", "", defaultTerm},
+		{"screen", "vt100", "dumb", "screen"},
+		{"screen", "", "", "screen"},
+	} {
+		client, err := dial(startServer(t, &Config{AuthType: "foo:bar", Term: c.force}), "foo", ssh.Password("bar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.env != "" {
+			if err := sess.Setenv("TERM", c.env); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := sess.RequestPty(c.pty, 24, 80, nil); err != nil {
+			t.Fatal(err)
+		}
+		out, err := sess.Output("echo $TERM")
+		if got := strings.TrimSpace(string(out)); err != nil || got != c.want {
+			t.Errorf("%+v: got %q (%v)", c, got, err)
+		}
+		sess.Close()
+		client.Close()
+	}
+}
+
+func TestMOTD(t *testing.T) {
+	client, err := dial(startServer(t, &Config{AuthType: "foo:bar", MOTD: "welcome\nto the server"}), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	//commands get none of the motd, with or without a pty
+	for _, pty := range []bool{false, true} {
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pty {
+			if err := sess.RequestPty("xterm", 24, 80, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		out, err := sess.Output("echo ok")
+		if strings.TrimSpace(string(out)) != "ok" || err != nil {
+			t.Errorf("pty %v: unexpected output %q (%v)", pty, out, err)
+		}
+		sess.Close()
+	}
+	//and shells are greeted
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := sess.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatal(err)
+	}
+	stdout, _ := sess.StdoutPipe()
+	if _, err := sess.StdinPipe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	if out := readUntil(t, stdout, "to the server\r\n"); !strings.HasPrefix(out, "welcome\r\nto the server\r\n") {
+		t.Errorf("expected the motd first, got %q", out)
+	}
+}
+
+func TestPipedShell(t *testing.T) {
+	client, err := dial(startServer(t, &Config{AuthType: "foo:bar", MOTD: "welcome"}), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	//like "ssh host < script.sh"
+	sess.Stdin = strings.NewReader("echo one\nx=2\necho $x\necho err >&2\nexit 3\n")
+	var stdout, stderr strings.Builder
+	sess.Stdout = &stdout
+	sess.Stderr = &stderr
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	err = sess.Wait()
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+		t.Errorf("expected exit status 3, got %v", err)
+	}
+	//no prompts, echo, motd or terminal control sequences
+	if stdout.String() != "one\n2\n" || stderr.String() != "err\n" {
+		t.Errorf("unexpected output %q, stderr %q", stdout.String(), stderr.String())
+	}
+}
@@ -0,0 +1,29 @@
+package sshd
+
+import "syscall"
+
+// signals maps SSH signal names (RFC 4254 section 6.10)
+// to their system signals
+var signals = map[string]syscall.Signal{
+	"ABRT": syscall.SIGABRT,
+	"ALRM": syscall.SIGALRM,
+	"FPE":  syscall.SIGFPE,
+	"HUP":  syscall.SIGHUP,
+	"ILL":  syscall.SIGILL,
+	"INT":  syscall.SIGINT,
+	"KILL": syscall.SIGKILL,
+	"PIPE": syscall.SIGPIPE,
+	"QUIT": syscall.SIGQUIT,
+	"SEGV": syscall.SIGSEGV,
+	"TERM": syscall.SIGTERM,
+}
+
+// signalName returns the SSH name of the given signal
+func signalName(sig syscall.Signal) (string, bool) {
+	for name, s := range signals {
+		if s == sig {
+			return name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,157 @@
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the server's activity counters
+type Stats struct {
+	Connections       int64
+	ActiveConnections int64
+	AuthSuccesses     int64
+	AuthFailures      int64
+	Sessions          int64
+	ActiveSessions    int64
+	BytesReceived     int64
+	BytesSent         int64
+	// AuthMethods breaks down authentication attempts by method
+	AuthMethods map[string]AuthStats
+}
+
+// AuthStats counts the attempts of an authentication method
+type AuthStats struct {
+	Successes int64
+	Failures  int64
+}
+
+type counters struct {
+	connections       atomic.Int64
+	activeConnections atomic.Int64
+	authSuccesses     atomic.Int64
+	authFailures      atomic.Int64
+	sessions          atomic.Int64
+	activeSessions    atomic.Int64
+	bytesReceived     atomic.Int64
+	bytesSent         atomic.Int64
+	authMut           sync.Mutex
+	authMethods       map[string]AuthStats
+}
+
+// auth counts an authentication attempt of the given method
+func (c *counters) auth(method string, success bool) {
+	if success {
+		c.authSuccesses.Add(1)
+	} else {
+		c.authFailures.Add(1)
+	}
+	c.authMut.Lock()
+	defer c.authMut.Unlock()
+	if c.authMethods == nil {
+		c.authMethods = map[string]AuthStats{}
+	}
+	m := c.authMethods[method]
+	if success {
+		m.Successes++
+	} else {
+		m.Failures++
+	}
+	c.authMethods[method] = m
+}
+
+// byteCounter is a Writer which only counts bytes
+type byteCounter struct {
+	n *atomic.Int64
+}
+
+func (b byteCounter) Write(p []byte) (int, error) {
+	b.n.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// Stats returns a snapshot of the server's activity counters
+func (s *Server) Stats() Stats {
+	c := &s.counters
+	st := Stats{
+		Connections:       c.connections.Load(),
+		ActiveConnections: c.activeConnections.Load(),
+		AuthSuccesses:     c.authSuccesses.Load(),
+		AuthFailures:      c.authFailures.Load(),
+		Sessions:          c.sessions.Load(),
+		ActiveSessions:    c.activeSessions.Load(),
+		BytesReceived:     c.bytesReceived.Load(),
+		BytesSent:         c.bytesSent.Load(),
+		AuthMethods:       map[string]AuthStats{},
+	}
+	c.authMut.Lock()
+	for method, m := range c.authMethods {
+		st.AuthMethods[method] = m
+	}
+	c.authMut.Unlock()
+	return st
+}
+
+// WritePrometheus writes the stats in the Prometheus
+// text exposition format
+func (st Stats) WritePrometheus(w io.Writer) error {
+	metrics := []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"sshd_connections_total", "counter", "Total SSH connections", st.Connections},
+		{"sshd_connections_active", "gauge", "Currently open SSH connections", st.ActiveConnections},
+		{"sshd_auth_successes_total", "counter", "Total successful authentication attempts", st.AuthSuccesses},
+		{"sshd_auth_failures_total", "counter", "Total failed authentication attempts", st.AuthFailures},
+		{"sshd_sessions_total", "counter", "Total session channels", st.Sessions},
+		{"sshd_sessions_active", "gauge", "Currently open session channels", st.ActiveSessions},
+		{"sshd_session_bytes_received_total", "counter", "Total bytes of session input", st.BytesReceived},
+		{"sshd_session_bytes_sent_total", "counter", "Total bytes of session output", st.BytesSent},
+	}
+	for _, m := range metrics {
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+		if err != nil {
+			return err
+		}
+	}
+	//per method, in a stable order
+	methods := make([]string, 0, len(st.AuthMethods))
+	for method := range st.AuthMethods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	const name = "sshd_auth_attempts_total"
+	if _, err := fmt.Fprintf(w, "# HELP %s Authentication attempts by method and result\n# TYPE %s counter\n", name, name); err != nil {
+		return err
+	}
+	for _, method := range methods {
+		m := st.AuthMethods[method]
+		_, err := fmt.Fprintf(w, "%s{method=%q,result=\"success\"} %d\n%s{method=%q,result=\"failure\"} %d\n",
+			name, method, m.Successes, name, method, m.Failures)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MetricsHandler serves the server's stats in the
+// Prometheus text exposition format
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.Stats().WritePrometheus(w)
+	})
+}
+
+// HealthHandler responds "OK", and the number of active
+// connections, for use as a load balancer liveness probe
+func (s *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "OK\nconnections %d\n", s.counters.activeConnections.Load())
+	})
+}
@@ -0,0 +1,176 @@
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a sample of the prometheus text exposition format,
+// with optional labels and an integer value
+var promSample = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="[^"\\]*"(,[a-zA-Z_][a-zA-Z0-9_]*="[^"\\]*")*\})? -?[0-9]+$`)
+
+// checkPrometheus validates the metrics of the given exposition
+// output, returning the value of each sample by its name and labels
+func checkPrometheus(t *testing.T, out string) map[string]string {
+	t.Helper()
+	if !strings.HasSuffix(out, "\n") {
+		t.Error("expected a final newline")
+	}
+	types := map[string]string{}
+	helps := map[string]bool{}
+	samples := map[string]string{}
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		if f := strings.SplitN(line, " ", 4); f[0] == "#" {
+			if len(f) < 4 {
+				t.Errorf("invalid comment %q", line)
+				continue
+			}
+			switch name := f[2]; f[1] {
+			case "HELP":
+				if helps[name] {
+					t.Errorf("duplicate HELP of %s", name)
+				}
+				helps[name] = true
+			case "TYPE":
+				if _, ok := types[name]; ok {
+					t.Errorf("duplicate TYPE of %s", name)
+				}
+				if f[3] != "counter" && f[3] != "gauge" {
+					t.Errorf("unexpected type %q", line)
+				}
+				if f[3] == "counter" && !strings.HasSuffix(name, "_total") {
+					t.Errorf("counter %s should end in _total", name)
+				}
+				types[name] = f[3]
+			}
+			continue
+		}
+		m := promSample.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("invalid sample %q", line)
+			continue
+		}
+		if _, ok := types[m[1]]; !ok {
+			t.Errorf("sample %q without a TYPE", line)
+		}
+		key, value, _ := strings.Cut(line, " ")
+		if _, ok := samples[key]; ok {
+			t.Errorf("duplicate sample %q", line)
+		}
+		samples[key] = value
+	}
+	return samples
+}
+
+func TestWritePrometheus(t *testing.T) {
+	st := Stats{
+		Connections:       3,
+		ActiveConnections: 1,
+		AuthSuccesses:     2,
+		AuthFailures:      1,
+		AuthMethods: map[string]AuthStats{
+			"publickey": {Successes: 2},
+			"password":  {Failures: 1},
+		},
+	}
+	var buf bytes.Buffer
+	if err := st.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	samples := checkPrometheus(t, buf.String())
+	for key, want := range map[string]string{
+		"sshd_connections_total":    "3",
+		"sshd_connections_active":   "1",
+		"sshd_auth_successes_total": "2",
+		"sshd_auth_failures_total":  "1",
+		"sshd_sessions_total":       "0",
+		`sshd_auth_attempts_total{method="password",result="failure"}`:  "1",
+		`sshd_auth_attempts_total{method="publickey",result="success"}`: "2",
+		`sshd_auth_attempts_total{method="publickey",result="failure"}`: "0",
+	} {
+		if samples[key] != want {
+			t.Errorf("%s: got %q, want %q", key, samples[key], want)
+		}
+	}
+}
+
+// get returns the body of the given url, once it is served
+func get(t *testing.T, url string) (*http.Response, string) {
+	t.Helper()
+	for i := 0; ; i++ {
+		resp, err := http.Get(url)
+		if err == nil {
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp, string(b)
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	port := freePort(t, "127.0.0.1")
+	metrics := net.JoinHostPort("127.0.0.1", freePort(t, "127.0.0.1"))
+	s, err := NewServer(&Config{AuthType: "foo:bar", Host: "127.0.0.1", Port: port, MetricsAddr: metrics})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startContext(t, s)
+	client := dialRetry(t, net.JoinHostPort("127.0.0.1", port))
+	if _, err := run(t, client, "echo ok"); err != nil {
+		t.Fatal(err)
+	}
+	resp, body := get(t, "http://"+metrics+"/metrics")
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	samples := checkPrometheus(t, body)
+	for key, want := range map[string]string{
+		"sshd_connections_total":  "1",
+		"sshd_connections_active": "1",
+		"sshd_sessions_total":     "1",
+		`sshd_auth_attempts_total{method="password",result="success"}`: "1",
+	} {
+		if samples[key] != want {
+			t.Errorf("%s: got %q, want %q", key, samples[key], want)
+		}
+	}
+	if samples["sshd_session_bytes_sent_total"] != "3" {
+		t.Errorf("expected the 3 bytes of output, got %q", samples["sshd_session_bytes_sent_total"])
+	}
+}
+
+func TestHealthEndpoint(t *testing.T) {
+	port := freePort(t, "127.0.0.1")
+	health := net.JoinHostPort("127.0.0.1", freePort(t, "127.0.0.1"))
+	s, err := NewServer(&Config{AuthType: "foo:bar", Host: "127.0.0.1", Port: port, HealthCheckAddr: health})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startContext(t, s)
+	//served without an ssh connection
+	resp, body := get(t, "http://"+health+"/")
+	if resp.StatusCode != http.StatusOK || body != "OK\nconnections 0\n" {
+		t.Errorf("unexpected response %d %q", resp.StatusCode, body)
+	}
+	dialRetry(t, net.JoinHostPort("127.0.0.1", port))
+	dialRetry(t, net.JoinHostPort("127.0.0.1", port))
+	if _, body := get(t, "http://"+health+"/"); body != "OK\nconnections 2\n" {
+		t.Errorf("unexpected response %q", body)
+	}
+}
@@ -0,0 +1,41 @@
+//go:build linux
+
+package sshd
+
+import (
+	"github.com/creack/pty"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+)
+
+// modeFlags are the terminal modes applied to a pty,
+// by their local flag in termios
+var modeFlags = map[uint8]uint32{
+	ssh.ECHO:   unix.ECHO,
+	ssh.ICANON: unix.ICANON,
+	ssh.ISIG:   unix.ISIG,
+}
+
+// setModes applies the given terminal modes to the pty
+func setModes(t pty.FdHolder, modes ssh.TerminalModes) error {
+	if len(modes) == 0 {
+		return nil
+	}
+	fd := int(t.Fd())
+	tio, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	for op, flag := range modeFlags {
+		v, ok := modes[op]
+		if !ok {
+			continue
+		}
+		if v != 0 {
+			tio.Lflag |= flag
+		} else {
+			tio.Lflag &^= flag
+		}
+	}
+	return unix.IoctlSetTermios(fd, unix.TCSETS, tio)
+}
@@ -0,0 +1,47 @@
+//go:build linux
+
+package sshd
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestTerminalModes(t *testing.T) {
+	client, err := dial(startServer(t, &Config{AuthType: "foo:bar"}), "foo", ssh.Password("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, echo := range []uint32{1, 0} {
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		//like a password prompt, which should not be echoed
+		if err := sess.RequestPty("xterm", 24, 80, ssh.TerminalModes{ssh.ECHO: echo}); err != nil {
+			t.Fatal(err)
+		}
+		var out strings.Builder
+		sess.Stdout = &out
+		stdin, err := sess.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sess.Start("read x; echo got-$x"); err != nil {
+			t.Fatal(err)
+		}
+		stdin.Write([]byte("secret\n"))
+		sess.Wait()
+		want := "got-secret\r\n"
+		if echo == 1 {
+			want = "secret\r\n" + want
+		}
+		if out.String() != want {
+			t.Errorf("echo %d: got %q, want %q", echo, out.String(), want)
+		}
+		sess.Close()
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package sshd
+
+import (
+	"github.com/creack/pty"
+	"golang.org/x/crypto/ssh"
+)
+
+// setModes is only supported on linux
+func setModes(t pty.FdHolder, modes ssh.TerminalModes) error {
+	return nil
+}
@@ -0,0 +1,98 @@
+//go:build !windows
+
+package sshd
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestX11Forwarding(t *testing.T) {
+	plain, denied, restricted, allowed := newSigner(t), newSigner(t), newSigner(t), newSigner(t)
+	keys := writeAuthorizedKeys(t,
+		plain,
+		authorizedKey("no-x11-forwarding", denied),
+		authorizedKey("restrict", restricted),
+		authorizedKey("restrict,x11-forwarding", allowed),
+	)
+	for _, c := range []struct {
+		name    string
+		enabled bool
+		key     ssh.Signer
+		ok      bool
+	}{
+		{"disabled", false, plain, false},
+		{"plain key", true, plain, true},
+		{"no-x11-forwarding", true, denied, false},
+		{"restrict", true, restricted, false},
+		{"restrict,x11-forwarding", true, allowed, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			addr := startServer(t, &Config{AuthType: keys, X11Forwarding: c.enabled})
+			client, err := dial(addr, "foo", ssh.PublicKeys(c.key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			//a fake x server, on the client, which greets x clients
+			channels := client.HandleChannelOpen("x11")
+			go func() {
+				for nc := range channels {
+					ch, reqs, err := nc.Accept()
+					if err != nil {
+						continue
+					}
+					go ssh.DiscardRequests(reqs)
+					ch.Write([]byte("hello x client"))
+					ch.Close()
+				}
+			}()
+			sess, err := client.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sess.Close()
+			//keep the cookie out of the user's own ~/.Xauthority
+			sess.Setenv("XAUTHORITY", filepath.Join(t.TempDir(), "Xauthority"))
+			ok, err := sess.SendRequest("x11-req", true, ssh.Marshal(x11Request{
+				AuthProtocol: "MIT-MAGIC-COOKIE-1",
+				AuthCookie:   "0123456789abcdef0123456789abcdef",
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != c.ok {
+				t.Fatalf("expected forwarding %v, got %v", c.ok, ok)
+			}
+			if !ok {
+				return
+			}
+			//connect to the session's display, as an x client would
+			stdout, _ := sess.StdoutPipe()
+			if err := sess.Start("echo $DISPLAY; sleep 5"); err != nil {
+				t.Fatal(err)
+			}
+			display, _ := bufio.NewReader(stdout).ReadString('\n')
+			host, screen, _ := strings.Cut(strings.TrimSpace(display), ":")
+			n, err := strconv.Atoi(strings.TrimSuffix(screen, ".0"))
+			if host != "localhost" || err != nil {
+				t.Fatalf("unexpected display %q", display)
+			}
+			conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(6000+n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if b, _ := io.ReadAll(conn); string(b) != "hello x client" {
+				t.Errorf("unexpected x server output %q", b)
+			}
+		})
+	}
+}
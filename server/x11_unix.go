@@ -0,0 +1,93 @@
+//go:build !windows
+
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// x11Request is the payload of an "x11-req" request
+type x11Request struct {
+	SingleConnection bool
+	AuthProtocol     string
+	AuthCookie       string
+	ScreenNumber     uint32
+}
+
+// x11DisplayOffset is the first display number tried,
+// leaving lower numbers for local X servers
+const x11DisplayOffset = 10
+
+// forwardX11 listens on the first free local display, and forwards
+// each X client connection to the ssh client over an "x11" channel.
+// The display is exposed to the session as DISPLAY.
+func (s *Server) forwardX11(sess *session, r x11Request) error {
+	var l net.Listener
+	display := 0
+	for n := x11DisplayOffset; n < 1000; n++ {
+		var err error
+		if l, err = net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(6000+n)); err == nil {
+			display = n
+			break
+		}
+	}
+	if l == nil {
+		return fmt.Errorf("no free x11 display")
+	}
+	screen := fmt.Sprintf("%d.%d", display, r.ScreenNumber)
+	//register the client's cookie, so x clients present it
+	if xauth, err := exec.LookPath("xauth"); err == nil {
+		cmd := exec.Command(xauth, "add", "unix:"+screen, r.AuthProtocol, r.AuthCookie)
+		cmd.Env = sess.env
+		if out, err := cmd.CombinedOutput(); err != nil {
+			s.debugf("Failed to add x11 cookie (%s: %s)", err, out)
+		}
+	}
+	sess.x11 = l
+	sess.env = appendEnv(sess.env, "DISPLAY=localhost:"+screen)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleX11Conn(sess.conn, c)
+			if r.SingleConnection {
+				l.Close()
+				return
+			}
+		}
+	}()
+	s.debugf("X11 forwarding on display %s", screen)
+	return nil
+}
+
+func (s *Server) handleX11Conn(sshConn *ssh.ServerConn, c net.Conn) {
+	defer c.Close()
+	origin := struct {
+		Address string
+		Port    uint32
+	}{}
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		origin.Address = addr.IP.String()
+		origin.Port = uint32(addr.Port)
+	}
+	ch, reqs, err := sshConn.OpenChannel("x11", ssh.Marshal(&origin))
+	if err != nil {
+		s.debugf("Failed to open x11 channel (%s)", err)
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(ch, c)
+		ch.CloseWrite()
+	}()
+	io.Copy(c, ch)
+}
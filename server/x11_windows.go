@@ -0,0 +1,17 @@
+//go:build windows
+
+package sshd
+
+import "fmt"
+
+// x11Request is the payload of an "x11-req" request
+type x11Request struct {
+	SingleConnection bool
+	AuthProtocol     string
+	AuthCookie       string
+	ScreenNumber     uint32
+}
+
+func (s *Server) forwardX11(sess *session, r x11Request) error {
+	return fmt.Errorf("x11 forwarding is not supported on windows")
+}